@@ -3,97 +3,153 @@ package client
 import (
 	"bufio"
 	"bytes"
-	"encoding/csv"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"io"
-	"strconv"
+	"sort"
+	"strings"
 	"time"
 )
 
 type VailClient struct {
 	Client 		*s3.S3
-	Csv  		*csv.Writer
+	Out  		RecordWriter
 	Bucket  	string
 	Prefix  	string
 	DeleteOnFail bool
+	// Versioned buckets keep the data of keys deleted without a version id
+	// behind a delete marker; that is only done when DeleteMarker is set.
+	Versioned    bool
+	DeleteMarker bool
+	// DeleteCategories are the failure categories that may be deleted or
+	// handed to OnFail; other failures are only reported.
+	DeleteCategories map[string]bool
+	// OnFail, when set, is called for objects that fail the test instead of
+	// deleting them, to set them aside for later; it returns what it did.
+	OnFail func(key string, versionId string, category string, reason string) (string, error)
+	// Verify is VerifyFull or VerifySample for a deep verify, reading the whole
+	// object or Samples ranges of SampleSize bytes, instead of the first bytes.
+	Verify     string
+	Samples    int
+	SampleSize int64
 }
 
 func (vail *VailClient) PrintObjectsPage (resp *s3.ListObjectsV2Output, more bool) bool {
-	_ = printObjectList(resp.Contents, vail.Csv)
+	_ = printObjectList(resp.Contents, vail.Out)
 	return *resp.IsTruncated
 }
 
-func printObjectList(objects  []*s3.Object, csv *csv.Writer) error {
+func (vail *VailClient) PrintObjects(objects []*s3.Object) error {
+	return printObjectList(objects, vail.Out)
+}
+
+func printObjectList(objects  []*s3.Object, out RecordWriter) error {
 	for _, object :=  range objects {
-		var line = []string {*object.Key, strconv.FormatInt(*object.Size, 10), *object.StorageClass,  object.LastModified.Format(time.RFC822)}
-		_ = csv.Write(line)	}
+		_ = out.Write(*object.Key, aws.Int64Value(object.Size), aws.StringValue(object.StorageClass), aws.TimeValue(object.LastModified))
+	}
 	return nil
 }
 
-func (vail *VailClient) HandleTestByteRestore(resp *s3.ListObjectsV2Output, more bool) bool {
-	// let them know we're here
-	fmt.Printf(".")
-	for _, object := range resp.Contents {
-		// Ignore glacier class
-		class := *object.StorageClass
-		if class == "GLACIER" {
-			var line = []string{*object.Key,
-				strconv.FormatBool(false), class, "", ""}
-			_ = vail.Csv.Write(line)
-			continue
-		}
+func (vail *VailClient) TestByteRestore(key string, class string) bool {
+	return vail.TestByteRestoreVersion(key, "", class)
+}
+
+// TestByteRestoreVersion tests one version of key, or the latest if versionId
+// is empty, and with DeleteOnFail deletes that exact version when it fails.
+// It returns whether the object could be restored. It is safe to call from
+// many goroutines at once.
+func (vail *VailClient) TestByteRestoreVersion(key string, versionId string, class string) bool {
+	// Ignore glacier class
+	if class == "GLACIER" {
+		_ = vail.Out.Write(key, versionId, false, CategoryArchived, class, "", "", "", "", 0, "", 0)
+		return false
+	}
 
-		success, err := testGetObject(vail.Client, vail.Bucket, *object.Key)
-		errorString := ""
-		deleteErrorString := ""
-		deleted := ""
+	var success bool
+	var err error
+	var checks []string
+	bytesRead := int64(0)
+	switch vail.Verify {
+	case VerifyFull:
+		success, checks, bytesRead, err = ReadFull(vail.Client, vail.Bucket, key, versionId)
+	case VerifySample:
+		success, checks, bytesRead, err = ReadSamples(vail.Client, vail.Bucket, key, versionId, vail.Samples, vail.SampleSize)
+	default:
+		success, err = TestGetObject(vail.Client, vail.Bucket, key, versionId)
+	}
+	category := ClassifyError(err)
+	errorString := ""
+	deleteErrorString := ""
+	deleted := ""
+	setAside := ""
+	setAsideErrorString := ""
+	if err != nil {
+		errorString = fmt.Sprintf("ERR: %v", err)
+	}
+	kept := ""
+	if !success && !vail.DeleteCategories[category] {
+		kept = fmt.Sprintf("kept, %s failures are not in the delete categories", category)
+	}
+	if vail.OnFail != nil && !success && len(kept) > 0 {
+		setAsideErrorString = kept
+	} else if vail.OnFail != nil && !success {
+		setAside, err = vail.OnFail(key, versionId, category, errorString)
 		if err != nil {
-			errorString = fmt.Sprintf("ERR: %v", err)
+			setAsideErrorString = fmt.Sprintf("ERR: %v", err)
 		}
-		if vail.DeleteOnFail && !success{
-			err = doDeleteObject(vail.Client, vail.Bucket, *object.Key)
-			if err != nil {
-				deleteErrorString = fmt.Sprintf("ERR: %v", err)
-			} else {
-				deleted = "Deleted"
-			}
+	} else if vail.DeleteOnFail && !success && len(kept) > 0 {
+		deleteErrorString = kept
+	} else if vail.DeleteOnFail && !success && vail.Versioned && versionId == "" && !vail.DeleteMarker {
+		deleteErrorString = "ERR: bucket is versioned and no version id is known, not deleted"
+	} else if vail.DeleteOnFail && !success {
+		err = doDeleteObject(vail.Client, vail.Bucket, key, versionId)
+		if err != nil {
+			deleteErrorString = fmt.Sprintf("ERR: %v", err)
+		} else {
+			deleted = "Deleted"
 		}
-		var line = []string {*object.Key,
-			strconv.FormatBool(success), deleted,  errorString, deleteErrorString}
-		_ = vail.Csv.Write(line)
 	}
-	return *resp.IsTruncated
+	_ = vail.Out.Write(key, versionId, success, category, deleted, errorString, deleteErrorString, setAside, setAsideErrorString,
+		TakeRetries(vail.Client, key, versionId), strings.Join(checks, "+"), bytesRead)
+	return success
 }
 
-func testGetObject(svc *s3.S3,  bucket string, key string) (bool, error) {
+// TestGetObject reads the first two bytes of key, or that version of it. It
+// returns false and the error if the request fails or its data cannot be read;
+// ClassifyError tells why.
+func TestGetObject(svc *s3.S3,  bucket string, key string, versionId string) (bool, error) {
 	requestInput := &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:  aws.String(key),
+		VersionId: optionalString(versionId),
 		Range: aws.String("bytes=0-1"),
 	}
 	getObjectRequest, getObjectResponse := svc.GetObjectRequest(requestInput)
 	err := getObjectRequest.Send()
 	if err != nil {
-		return false, fmt.Errorf("falied to retrieve %s from bucket %s, %v\n",
+		return false, fmt.Errorf("falied to retrieve %s from bucket %s, %w\n",
 			key, bucket, err)
 	}
+	defer getObjectResponse.Body.Close()
 
 	// ascertain that data is there
 	var b bytes.Buffer
 	w := bufio.NewWriter(&b)
 
 	_, err = io.Copy(w, getObjectResponse.Body)
-	// return false on error (expected); return error only if communication failed
-	return err == nil, nil
+	if err != nil {
+		return false, &bodyReadError{err}
+	}
+	return true, nil
 }
 
 
-func doDeleteObject(svc *s3.S3,  bucket string, key string) error {
+func doDeleteObject(svc *s3.S3,  bucket string, key string, versionId string) error {
 	requestInput := &s3.DeleteObjectInput{
 		Bucket: aws.String(bucket),
 		Key:  aws.String(key),
+		VersionId: optionalString(versionId),
 	}
 	_, err := svc.DeleteObject(requestInput)
 	if err != nil {
@@ -103,26 +159,48 @@ func doDeleteObject(svc *s3.S3,  bucket string, key string) error {
 	return nil
 }
 
-func (vail *VailClient) PrintTestRestoreCsvHeader() error {
-	var line = []string {"Key","Restorable","Deleted","Error","Delete Error"}
-	return vail.Csv.Write(line)
-}
-
-func (vail *VailClient) PrintListBucketsCsvHeader() error {
-	var line = []string {"Name","Creation Date"}
-	return vail.Csv.Write(line)
+// PrintObjectVersionsPage writes the versions and delete markers of a page in
+// key order, newest first for each key.
+func (vail *VailClient) PrintObjectVersionsPage(resp *s3.ListObjectVersionsOutput, more bool) bool {
+	type row struct {
+		key          string
+		lastModified time.Time
+		values       []interface{}
+	}
+	rows := []row{}
+	for _, version := range resp.Versions {
+		rows = append(rows, row{aws.StringValue(version.Key), aws.TimeValue(version.LastModified), []interface{}{
+			aws.StringValue(version.Key), aws.StringValue(version.VersionId), aws.BoolValue(version.IsLatest), false,
+			aws.Int64Value(version.Size), aws.StringValue(version.StorageClass), aws.TimeValue(version.LastModified)}})
+	}
+	for _, marker := range resp.DeleteMarkers {
+		rows = append(rows, row{aws.StringValue(marker.Key), aws.TimeValue(marker.LastModified), []interface{}{
+			aws.StringValue(marker.Key), aws.StringValue(marker.VersionId), aws.BoolValue(marker.IsLatest), true,
+			nil, nil, aws.TimeValue(marker.LastModified)}})
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].key != rows[j].key {
+			return rows[i].key < rows[j].key
+		}
+		return rows[i].lastModified.After(rows[j].lastModified)
+	})
+	for _, r := range rows {
+		_ = vail.Out.Write(r.values...)
+	}
+	return aws.BoolValue(resp.IsTruncated)
 }
 
-func (vail *VailClient) PrintBucketObjectsCsvHeader() error {
-	var line = []string {"Key","Size","Storage Class","Creation Date"}
-	return vail.Csv.Write(line)
+// optionalString leaves an empty request field unset.
+func optionalString(value string) *string {
+	if len(value) == 0 {
+		return nil
+	}
+	return aws.String(value)
 }
 
 func (vail *VailClient) PrintBucketList(buckets  []*s3.Bucket) error {
 	for _, bucket :=  range buckets {
-		var line = []string {*bucket.Name, bucket.CreationDate.Format(time.RFC822)}
-		_ = vail.Csv.Write(line)
+		_ = vail.Out.Write(*bucket.Name, aws.TimeValue(bucket.CreationDate))
 	}
 	return nil
 }
-
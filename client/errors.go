@@ -0,0 +1,148 @@
+package client
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Categories of test_byte_restore failures
+const (
+	CategoryDataMissing = "data-missing"
+	CategoryArchived    = "archived"
+	CategoryPermission  = "permission"
+	CategoryThrottled   = "throttled"
+	CategoryTransient   = "transient-network"
+	CategoryUnknown     = "unknown"
+	// found only by a deep verify
+	CategoryPartial  = "partially-readable"
+	CategoryMismatch = "checksum-mismatch"
+)
+
+// Categories lists every failure category.
+var Categories = []string{CategoryDataMissing, CategoryArchived, CategoryPermission,
+	CategoryThrottled, CategoryTransient, CategoryUnknown, CategoryPartial, CategoryMismatch}
+
+// bodyReadError is a GET that was accepted but whose data could not be read,
+// which is how an object with missing data shows itself.
+type bodyReadError struct {
+	err error
+}
+
+func (e *bodyReadError) Error() string {
+	return fmt.Sprintf("failed reading object data, %v", e.err)
+}
+
+func (e *bodyReadError) Unwrap() error {
+	return e.err
+}
+
+// ClassifyError sorts an error from a request into one of the categories.
+// Only a missing key or version, or data that cannot be read back after S3
+// accepted the request (other than a read timeout), count as data-missing.
+func ClassifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+	var mismatchErr *checksumMismatchError
+	if errors.As(err, &mismatchErr) {
+		return CategoryMismatch
+	}
+	var partialErr *partialReadError
+	if errors.As(err, &partialErr) {
+		// a read that stalled or dropped part way may well finish next time
+		if isBodyNetworkError(partialErr.err) {
+			return CategoryTransient
+		}
+		return CategoryPartial
+	}
+	var readErr *bodyReadError
+	if errors.As(err, &readErr) {
+		// a stalled or dropped read is the network; a body cut short is the data
+		if isBodyNetworkError(readErr.err) {
+			return CategoryTransient
+		}
+		return CategoryDataMissing
+	}
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case "NoSuchKey", "NoSuchVersion", "NotFound":
+			return CategoryDataMissing
+		case "InvalidObjectState":
+			return CategoryArchived
+		case "AccessDenied", "Forbidden", "AllAccessDisabled", "InvalidAccessKeyId",
+			"SignatureDoesNotMatch", "ExpiredToken", "InvalidToken", "AccountProblem":
+			return CategoryPermission
+		case "SlowDown", "ServiceUnavailable", "TooManyRequests":
+			return CategoryThrottled
+		case request.CanceledErrorCode:
+			return CategoryTransient
+		}
+		if request.IsErrorThrottle(aerr) {
+			return CategoryThrottled
+		}
+		if aerr.Code() == request.ErrCodeRequestError || aerr.Code() == request.ErrCodeResponseTimeout ||
+			aerr.Code() == request.ErrCodeRead || aerr.Code() == "RequestTimeout" {
+			return CategoryTransient
+		}
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		switch status := reqErr.StatusCode(); {
+		case status == 404:
+			return CategoryDataMissing
+		case status == 403:
+			return CategoryPermission
+		case status == 429 || status == 503:
+			return CategoryThrottled
+		case status == 500 || status == 502 || status == 504:
+			return CategoryTransient
+		}
+	}
+	if isNetworkError(err) {
+		return CategoryTransient
+	}
+	return CategoryUnknown
+}
+
+// isBodyNetworkError tells a failed body read caused by the network, such as
+// a timeout, reset connection or TLS alert, from a body that ended before its
+// Content-Length, which is how missing data shows itself.
+func isBodyNetworkError(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return false
+	}
+	return isNetworkError(err)
+}
+
+// isNetworkError spots timeouts, dropped connections and TLS failures
+// anywhere in the chain of err, including the original error of an SDK error.
+func isNetworkError(err error) bool {
+	for err != nil {
+		var netErr net.Error
+		var certErr x509.UnknownAuthorityError
+		var hostErr x509.HostnameError
+		if errors.As(err, &netErr) || errors.As(err, &certErr) || errors.As(err, &hostErr) {
+			return true
+		}
+		message := err.Error()
+		if strings.Contains(message, "connection reset") || strings.Contains(message, "tls:") ||
+			strings.Contains(message, "unexpected EOF") || strings.Contains(message, "broken pipe") {
+			return true
+		}
+		if aerr, ok := err.(awserr.Error); ok {
+			err = aerr.OrigErr()
+		} else {
+			err = errors.Unwrap(err)
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func requestFailure(code string, status int) error {
+	return awserr.NewRequestFailure(awserr.New(code, "message", nil), status, "request-id")
+}
+
+func TestClassifyError(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	brokenPipe := &net.OpError{Op: "write", Net: "tcp", Err: syscall.EPIPE}
+	tlsAlert := &net.OpError{Op: "remote error", Err: errors.New("tls: bad record MAC")}
+	timeout := &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, ""},
+
+		{"NoSuchKey", requestFailure("NoSuchKey", 404), CategoryDataMissing},
+		{"NoSuchVersion", requestFailure("NoSuchVersion", 404), CategoryDataMissing},
+		{"NotFound", requestFailure("NotFound", 404), CategoryDataMissing},
+		{"InvalidObjectState", requestFailure("InvalidObjectState", 403), CategoryArchived},
+		{"AccessDenied", requestFailure("AccessDenied", 403), CategoryPermission},
+		{"SignatureDoesNotMatch", requestFailure("SignatureDoesNotMatch", 403), CategoryPermission},
+		{"SlowDown", requestFailure("SlowDown", 503), CategoryThrottled},
+		{"ServiceUnavailable", requestFailure("ServiceUnavailable", 503), CategoryThrottled},
+		{"RequestLimitExceeded", requestFailure("RequestLimitExceeded", 400), CategoryThrottled},
+		{"Canceled", awserr.New(request.CanceledErrorCode, "canceled", nil), CategoryTransient},
+		{"RequestError", awserr.New(request.ErrCodeRequestError, "send request failed", reset), CategoryTransient},
+		{"RequestTimeout", requestFailure("RequestTimeout", 400), CategoryTransient},
+
+		{"status 404", requestFailure("", 404), CategoryDataMissing},
+		{"status 403", requestFailure("", 403), CategoryPermission},
+		{"status 429", requestFailure("", 429), CategoryThrottled},
+		{"status 503", requestFailure("", 503), CategoryThrottled},
+		{"status 500", requestFailure("InternalError", 500), CategoryTransient},
+		{"status 502", requestFailure("", 502), CategoryTransient},
+		{"status 504", requestFailure("", 504), CategoryTransient},
+		{"status 400", requestFailure("InvalidArgument", 400), CategoryUnknown},
+
+		{"wrapped NoSuchKey", fmt.Errorf("falied to retrieve k, %w", requestFailure("NoSuchKey", 404)), CategoryDataMissing},
+		{"wrapped SlowDown", fmt.Errorf("falied to retrieve k, %w", requestFailure("SlowDown", 503)), CategoryThrottled},
+		{"net reset", reset, CategoryTransient},
+		{"wrapped net timeout", fmt.Errorf("get: %w", timeout), CategoryTransient},
+		{"unknown authority", fmt.Errorf("get: %w", x509.UnknownAuthorityError{}), CategoryTransient},
+
+		{"body cut short", &bodyReadError{io.ErrUnexpectedEOF}, CategoryDataMissing},
+		{"body other error", &bodyReadError{errors.New("checksum failed")}, CategoryDataMissing},
+		{"body reset", &bodyReadError{reset}, CategoryTransient},
+		{"body broken pipe", &bodyReadError{brokenPipe}, CategoryTransient},
+		{"body tls alert", &bodyReadError{tlsAlert}, CategoryTransient},
+		{"body timeout", &bodyReadError{timeout}, CategoryTransient},
+		{"wrapped body reset", fmt.Errorf("k: %w", &bodyReadError{reset}), CategoryTransient},
+
+		{"partial cut short", &partialReadError{"read 5 of 10 bytes", io.ErrUnexpectedEOF}, CategoryPartial},
+		{"partial missing range", &partialReadError{"1 of 2 sampled ranges read", requestFailure("NoSuchKey", 404)}, CategoryPartial},
+		{"partial reset", &partialReadError{"read 5 of 10 bytes", reset}, CategoryTransient},
+		{"partial timeout", &partialReadError{"read 5 of 10 bytes", timeout}, CategoryTransient},
+		{"checksum mismatch", &checksumMismatchError{"md5 expected a got b"}, CategoryMismatch},
+
+		{"plain error", errors.New("something else"), CategoryUnknown},
+	}
+	for _, test := range tests {
+		if got := ClassifyError(test.err); got != test.want {
+			t.Errorf("%s: ClassifyError(%v) = %q, want %q", test.name, test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// adaptiveCooldown is the least time between two cuts of the concurrency, so
+// one burst of throttling does not halve it over and over.
+const adaptiveCooldown = time.Second
+
+// tokenBucket hands out rate tokens a second with up to one second of burst.
+// A caller may take more tokens than are left and then waits off the debt, so
+// large reads are paced without being split.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (bucket *tokenBucket) wait(n float64) {
+	if bucket == nil {
+		return
+	}
+	bucket.mu.Lock()
+	now := time.Now()
+	bucket.tokens = math.Min(bucket.rate, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+	bucket.tokens -= n
+	delay := time.Duration(0)
+	if bucket.tokens < 0 {
+		delay = time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+	}
+	bucket.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// Limiter paces every S3 and Glacier request it is installed on. Requests
+// per second and bytes per second read from responses are held under
+// token-bucket limits. With MaxConcurrency set, the requests in flight are
+// capped by a limit that halves when the endpoint throttles, shrinks when
+// responses, reading the body included, take longer than TargetLatency, and
+// grows by one for each window of healthy responses, back up to
+// MaxConcurrency.
+type Limiter struct {
+	MaxConcurrency int
+	TargetLatency  time.Duration
+
+	requests *tokenBucket
+	bytes    *tokenBucket
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	limit        float64
+	inFlight     int
+	healthy      int
+	lastDecrease time.Time
+	started      map[*request.Request]time.Time
+}
+
+// NewLimiter makes a Limiter; a rate of 0 or a maxConcurrency of 0 turns that
+// limit off.
+func NewLimiter(requestsPerSecond float64, bytesPerSecond float64, maxConcurrency int, targetLatency time.Duration) *Limiter {
+	limiter := &Limiter{
+		MaxConcurrency: maxConcurrency,
+		TargetLatency:  targetLatency,
+		requests:       newTokenBucket(requestsPerSecond),
+		bytes:          newTokenBucket(bytesPerSecond),
+		limit:          float64(maxConcurrency),
+		started:        map[*request.Request]time.Time{},
+	}
+	limiter.cond = sync.NewCond(&limiter.mu)
+	return limiter
+}
+
+// Install paces the requests of an S3 or Glacier client. Each attempt,
+// retries included, takes a request token and a slot. A response body the
+// caller reads, as from GetObject, keeps its slot until it is closed, so the
+// transfer counts towards the concurrency and the latency.
+func (limiter *Limiter) Install(c *awsclient.Client) {
+	c.Handlers.Send.PushFront(limiter.acquire)
+	c.Handlers.Send.PushBack(limiter.limitBody)
+	c.Handlers.CompleteAttempt.PushBack(limiter.completeAttempt)
+}
+
+// Concurrency is the current limit on requests in flight, 0 without one.
+func (limiter *Limiter) Concurrency() int {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	return int(limiter.limit)
+}
+
+func (limiter *Limiter) acquire(r *request.Request) {
+	limiter.requests.wait(1)
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	for limiter.MaxConcurrency > 0 && limiter.inFlight >= int(limiter.limit) {
+		limiter.cond.Wait()
+	}
+	limiter.inFlight++
+	limiter.started[r] = time.Now()
+}
+
+func (limiter *Limiter) limitBody(r *request.Request) {
+	if r.HTTPResponse != nil && r.HTTPResponse.Body != nil {
+		r.HTTPResponse.Body = &limitedBody{body: r.HTTPResponse.Body, bucket: limiter.bytes, limiter: limiter, request: r}
+	}
+}
+
+// completeAttempt releases the slot of a failed attempt or of one whose body
+// the SDK has already read and closed. A successful response whose body is
+// left to the caller is released when that body is closed.
+func (limiter *Limiter) completeAttempt(r *request.Request) {
+	if r.Error == nil && r.HTTPResponse != nil {
+		if body, ok := r.HTTPResponse.Body.(*limitedBody); ok && body.hold() {
+			return
+		}
+	}
+	limiter.release(r, r.Error)
+}
+
+func (limiter *Limiter) release(r *request.Request, err error) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	started, ok := limiter.started[r]
+	if !ok {
+		return
+	}
+	delete(limiter.started, r)
+	limiter.inFlight--
+	defer limiter.cond.Broadcast()
+	if limiter.MaxConcurrency == 0 {
+		return
+	}
+
+	category := ClassifyError(err)
+	slow := limiter.TargetLatency > 0 && time.Since(started) > limiter.TargetLatency
+	switch {
+	case category == CategoryThrottled:
+		limiter.decrease(0.5, "throttled")
+	case slow:
+		limiter.decrease(0.75, "slow responses")
+	case category == CategoryTransient || category == CategoryUnknown:
+		// says nothing either way about the load on the endpoint
+	default:
+		limiter.healthy++
+		if limiter.healthy >= int(limiter.limit) && int(limiter.limit) < limiter.MaxConcurrency {
+			limiter.limit++
+			limiter.healthy = 0
+		}
+	}
+}
+
+// decrease cuts the limit by factor, at most once per adaptiveCooldown. The
+// caller holds mu.
+func (limiter *Limiter) decrease(factor float64, reason string) {
+	if time.Since(limiter.lastDecrease) < adaptiveCooldown {
+		return
+	}
+	limiter.lastDecrease = time.Now()
+	limiter.healthy = 0
+	limit := math.Max(1, math.Floor(limiter.limit*factor))
+	if limit < limiter.limit {
+		limiter.limit = limit
+		fmt.Fprintf(os.Stderr, "Concurrency reduced to %d, %s\n", int(limit), reason)
+	}
+}
+
+// limitedBody paces reads of a response body to the bandwidth limit, and
+// once held releases the slot of its request on Close, judged by the first
+// error reading it.
+type limitedBody struct {
+	body    io.ReadCloser
+	bucket  *tokenBucket
+	limiter *Limiter
+	request *request.Request
+
+	mu      sync.Mutex
+	held    bool
+	closed  bool
+	readErr error
+}
+
+func (body *limitedBody) Read(p []byte) (int, error) {
+	n, err := body.body.Read(p)
+	if n > 0 {
+		body.bucket.wait(float64(n))
+	}
+	if err != nil && err != io.EOF {
+		body.mu.Lock()
+		if body.readErr == nil {
+			body.readErr = &bodyReadError{err}
+		}
+		body.mu.Unlock()
+	}
+	return n, err
+}
+
+// hold keeps the slot until Close, unless the body is already closed.
+func (body *limitedBody) hold() bool {
+	body.mu.Lock()
+	defer body.mu.Unlock()
+	body.held = !body.closed
+	return body.held
+}
+
+func (body *limitedBody) Close() error {
+	err := body.body.Close()
+	body.mu.Lock()
+	release := body.held
+	body.held = false
+	body.closed = true
+	readErr := body.readErr
+	body.mu.Unlock()
+	if release {
+		body.limiter.release(body.request, readErr)
+	}
+	return err
+}
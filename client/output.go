@@ -0,0 +1,199 @@
+package client
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output formats for listings and reports
+const (
+	FormatCsv    = "csv"
+	FormatJson   = "json"
+	FormatNdjson = "ndjson"
+)
+
+// Columns of each listing
+var (
+	ListBucketsColumns    = []string{"Name", "Creation Date"}
+	BucketObjectsColumns  = []string{"Key", "Size", "Storage Class", "Creation Date"}
+	ObjectVersionsColumns = []string{"Key", "Version Id", "Latest", "Delete Marker", "Size", "Storage Class", "Creation Date"}
+	VaultArchivesColumns  = []string{"Archive Id", "Description", "Size", "Creation Date", "SHA256 Tree Hash"}
+	TestRestoreColumns    = []string{"Key", "Version Id", "Restorable", "Category", "Deleted", "Error", "Delete Error", "Set Aside", "Set Aside Error", "Retries", "Checks", "Bytes Read"}
+)
+
+// RecordWriter writes one record per call, with values in column order.
+// Values keep their type: numbers and booleans stay numbers and booleans in
+// JSON, times are written as RFC3339 and a zero time as empty (null in JSON).
+// Implementations are safe for concurrent use.
+type RecordWriter interface {
+	Write(values ...interface{}) error
+	Close() error
+}
+
+// OutputFormat returns format, or when it is empty the format implied by
+// fileName: .json for a JSON array, .ndjson or .jsonl for NDJSON, else CSV.
+func OutputFormat(fileName string, format string) (string, error) {
+	switch strings.ToLower(format) {
+	case FormatCsv, FormatJson, FormatNdjson:
+		return strings.ToLower(format), nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown format '%s', use csv, json or ndjson", format)
+	}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		return FormatJson, nil
+	case ".ndjson", ".jsonl":
+		return FormatNdjson, nil
+	}
+	return FormatCsv, nil
+}
+
+// NewRecordWriter writes records with the given columns to w. CSV output
+// starts with a header line; JSON records are objects keyed by the column
+// names without spaces.
+func NewRecordWriter(w io.Writer, format string, columns []string) (RecordWriter, error) {
+	switch format {
+	case FormatCsv:
+		out := &csvRecordWriter{csv: csv.NewWriter(w)}
+		if err := out.csv.Write(columns); err != nil {
+			return nil, err
+		}
+		return out, nil
+	case FormatJson, FormatNdjson:
+		out := &jsonRecordWriter{w: w, array: format == FormatJson}
+		for _, column := range columns {
+			out.keys = append(out.keys, strings.ReplaceAll(column, " ", ""))
+		}
+		if out.array {
+			if _, err := io.WriteString(w, "["); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown format '%s', use csv, json or ndjson", format)
+}
+
+type csvRecordWriter struct {
+	mu  sync.Mutex
+	csv *csv.Writer
+}
+
+func (out *csvRecordWriter) Write(values ...interface{}) error {
+	line := make([]string, len(values))
+	for i, value := range values {
+		line[i] = csvValue(value)
+	}
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	return out.csv.Write(line)
+}
+
+func (out *csvRecordWriter) Close() error {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	out.csv.Flush()
+	return out.csv.Error()
+}
+
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case int:
+		return strconv.Itoa(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.Format(time.RFC3339)
+	case error:
+		return v.Error()
+	}
+	return fmt.Sprint(value)
+}
+
+type jsonRecordWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	keys  []string
+	array bool
+	rows  int
+}
+
+func (out *jsonRecordWriter) Write(values ...interface{}) error {
+	// build the object by hand to keep the columns in order
+	line := []byte("{")
+	for i, key := range out.keys {
+		var value interface{}
+		if i < len(values) {
+			value = jsonValue(values[i])
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			line = append(line, ',')
+		}
+		name, _ := json.Marshal(key)
+		line = append(append(append(line, name...), ':'), encoded...)
+	}
+	line = append(line, '}')
+
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	out.rows++
+	if out.array {
+		if out.rows > 1 {
+			line = append([]byte(",\n"), line...)
+		} else {
+			line = append([]byte("\n"), line...)
+		}
+	} else {
+		line = append(line, '\n')
+	}
+	_, err := out.w.Write(line)
+	return err
+}
+
+func (out *jsonRecordWriter) Close() error {
+	if !out.array {
+		return nil
+	}
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	_, err := io.WriteString(out.w, "\n]\n")
+	return err
+}
+
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		if v.IsZero() {
+			return nil
+		}
+		return v.Format(time.RFC3339)
+	case error:
+		return v.Error()
+	case string:
+		if len(v) == 0 {
+			return nil
+		}
+	}
+	return value
+}
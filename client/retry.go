@@ -0,0 +1,135 @@
+package client
+
+import (
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// RetryPolicy is the request.Retryer for every S3 call: restore, head, get,
+// list and delete alike. Throttled and transient failures are retried with
+// exponential backoff and jitter; throttling (SlowDown, RequestLimitExceeded,
+// ServiceUnavailable) backs off from a longer base delay. Failures that will
+// not change on a retry, such as a missing key or access denied, are not
+// retried. The retries each key needed are counted for reports.
+type RetryPolicy struct {
+	MaxAttempts   int
+	BaseDelay     time.Duration
+	ThrottleDelay time.Duration
+	MaxDelay      time.Duration
+
+	mu      sync.Mutex
+	retries map[string]int
+}
+
+// Install makes policy the retryer of an S3 or Glacier client and counts the
+// retries of each request that names a key.
+func (policy *RetryPolicy) Install(c *awsclient.Client) {
+	c.Retryer = policy
+	c.Config.Retryer = policy
+	// decide every retry here, not only those the SDK left undecided
+	c.Config.EnforceShouldRetryCheck = aws.Bool(true)
+	c.Handlers.Complete.PushBack(policy.count)
+}
+
+func (policy *RetryPolicy) MaxRetries() int {
+	if policy.MaxAttempts < 1 {
+		return 0
+	}
+	return policy.MaxAttempts - 1
+}
+
+func (policy *RetryPolicy) ShouldRetry(r *request.Request) bool {
+	if r.Error == nil {
+		return false
+	}
+	if aerr, ok := r.Error.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+		return false
+	}
+	switch ClassifyError(r.Error) {
+	case CategoryThrottled, CategoryTransient:
+		return true
+	case CategoryDataMissing, CategoryArchived, CategoryPermission:
+		return false
+	}
+	return r.IsErrorRetryable()
+}
+
+// RetryRules waits a random time between half and all of the base delay
+// doubled for each retry so far, capped at MaxDelay.
+func (policy *RetryPolicy) RetryRules(r *request.Request) time.Duration {
+	delay := policy.BaseDelay
+	if ClassifyError(r.Error) == CategoryThrottled {
+		delay = policy.ThrottleDelay
+	}
+	for i := 0; i < r.RetryCount && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func retryKey(key string, versionId string) string {
+	return key + "\x00" + versionId
+}
+
+func (policy *RetryPolicy) count(r *request.Request) {
+	if r.RetryCount == 0 {
+		return
+	}
+	params := reflect.Indirect(reflect.ValueOf(r.Params))
+	if params.Kind() != reflect.Struct {
+		return
+	}
+	field := params.FieldByName("Key")
+	if !field.IsValid() {
+		return
+	}
+	key, ok := field.Interface().(*string)
+	if !ok || key == nil {
+		return
+	}
+	versionId := ""
+	if field = params.FieldByName("VersionId"); field.IsValid() {
+		if value, ok := field.Interface().(*string); ok {
+			versionId = aws.StringValue(value)
+		}
+	}
+	policy.mu.Lock()
+	defer policy.mu.Unlock()
+	if policy.retries == nil {
+		policy.retries = map[string]int{}
+	}
+	policy.retries[retryKey(*key, versionId)] += r.RetryCount
+}
+
+// TakeRetries returns the retries counted for key, or that version of it,
+// since it was last taken.
+func (policy *RetryPolicy) TakeRetries(key string, versionId string) int {
+	policy.mu.Lock()
+	defer policy.mu.Unlock()
+	count := policy.retries[retryKey(key, versionId)]
+	delete(policy.retries, retryKey(key, versionId))
+	return count
+}
+
+// TakeRetries returns the retries counted for key by the RetryPolicy of svc,
+// or 0 without one.
+func TakeRetries(svc *s3.S3, key string, versionId string) int {
+	if policy, ok := svc.Retryer.(*RetryPolicy); ok {
+		return policy.TakeRetries(key, versionId)
+	}
+	return 0
+}
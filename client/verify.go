@@ -0,0 +1,390 @@
+package client
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Deep verify modes for test_byte_restore; the default reads the first bytes.
+const (
+	VerifyFull   = "full"
+	VerifySample = "sample"
+)
+
+// commonPartSizesMB are the part sizes popular upload tools use, tried when
+// S3 will not tell us the size of the first part.
+var commonPartSizesMB = []int64{5, 8, 15, 16, 32, 64, 100, 128, 256, 512}
+
+// partialReadError is an object of which only some of the data could be read.
+type partialReadError struct {
+	detail string
+	err    error
+}
+
+func (e *partialReadError) Error() string {
+	return fmt.Sprintf("partially readable, %s, %v", e.detail, e.err)
+}
+
+func (e *partialReadError) Unwrap() error {
+	return e.err
+}
+
+// checksumMismatchError is an object that was read in full but does not
+// match its checksum or ETag.
+type checksumMismatchError struct {
+	detail string
+}
+
+func (e *checksumMismatchError) Error() string {
+	return "checksum mismatch, " + e.detail
+}
+
+// ReadFull reads all of key, or that version of it, throwing the data away
+// while it computes the checksums S3 holds for the object and the ETag when it
+// is an MD5. It returns the checks made and the bytes read. Data that stops
+// part way is a partially readable object; data that does not match is a
+// checksum mismatch. The checks are set up from a HEAD made before the GET,
+// as an open GET body holds a request slot of the Limiter.
+func ReadFull(svc *s3.S3, bucket string, key string, versionId string) (bool, []string, int64, error) {
+	head, err := svc.HeadObject(
+		&s3.HeadObjectInput{
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(key),
+			VersionId:    optionalString(versionId),
+			ChecksumMode: aws.String(s3.ChecksumModeEnabled)})
+	if err != nil {
+		return false, nil, 0, fmt.Errorf("falied to retrieve %s from bucket %s, %w\n", key, bucket, err)
+	}
+	checker := NewObjectChecker(svc, bucket, key, versionId, head)
+
+	// the data read must be the object the checks were set up for
+	get, err := svc.GetObject(
+		&s3.GetObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(key),
+			VersionId: optionalString(versionId),
+			IfMatch:   head.ETag})
+	if err != nil {
+		return false, nil, 0, fmt.Errorf("falied to retrieve %s from bucket %s, %w\n", key, bucket, err)
+	}
+	defer get.Body.Close()
+
+	size := aws.Int64Value(get.ContentLength)
+	read, err := io.Copy(checker, get.Body)
+	if err == nil && read < size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && read == 0 {
+		return false, nil, 0, &bodyReadError{err}
+	}
+	if err != nil {
+		return false, nil, read, &partialReadError{fmt.Sprintf("read %d of %d bytes", read, size), err}
+	}
+	checks, _, err := checker.Verify()
+	if len(checks) == 0 {
+		checks = []string{"unverified"}
+	}
+	return err == nil, checks, read, err
+}
+
+// ReadSamples reads count ranges of sampleSize bytes spread evenly over key,
+// first and last included. Objects with some ranges that can be read and some
+// whose data is missing are partially readable.
+func ReadSamples(svc *s3.S3, bucket string, key string, versionId string, count int, sampleSize int64) (bool, []string, int64, error) {
+	head, err := svc.HeadObject(
+		&s3.HeadObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(key),
+			VersionId: optionalString(versionId)})
+	if err != nil {
+		return false, nil, 0, fmt.Errorf("falied to retrieve %s from bucket %s, %w\n", key, bucket, err)
+	}
+	size := aws.Int64Value(head.ContentLength)
+	ranges := sampleRanges(size, count, sampleSize)
+	var read int64
+	var missingErr error
+	readable := 0
+	for _, start := range ranges {
+		end := start + sampleSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		n, err := readRange(svc, bucket, key, versionId, start, end)
+		read += n
+		if err != nil && ClassifyError(err) != CategoryDataMissing {
+			// throttling and the like say nothing about the data
+			return false, nil, read, err
+		}
+		if err != nil {
+			if missingErr == nil {
+				missingErr = fmt.Errorf("bytes %d-%d, %w", start, end, err)
+			}
+			continue
+		}
+		readable++
+	}
+	checks := []string{fmt.Sprintf("sampled-%d/%d", readable, len(ranges))}
+	switch {
+	case readable == len(ranges):
+		return true, checks, read, nil
+	case readable == 0:
+		return false, checks, read, missingErr
+	}
+	return false, checks, read, &partialReadError{fmt.Sprintf("%d of %d sampled ranges read", readable, len(ranges)), missingErr}
+}
+
+// sampleRanges spreads the starts of count ranges evenly over an object of
+// size bytes. Small objects are read in one range.
+func sampleRanges(size int64, count int, sampleSize int64) []int64 {
+	if size == 0 {
+		return nil
+	}
+	if count < 2 || sampleSize >= size {
+		return []int64{0}
+	}
+	starts := []int64{}
+	last := size - sampleSize
+	for i := 0; i < count; i++ {
+		start := last * int64(i) / int64(count-1)
+		if len(starts) > 0 && start < starts[len(starts)-1]+sampleSize {
+			// ranges would overlap, move on to one that does not
+			if start = starts[len(starts)-1] + sampleSize; start > last {
+				break
+			}
+		}
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+func readRange(svc *s3.S3, bucket string, key string, versionId string, start int64, end int64) (int64, error) {
+	get, err := svc.GetObject(
+		&s3.GetObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(key),
+			VersionId: optionalString(versionId),
+			Range:     aws.String(fmt.Sprintf("bytes=%d-%d", start, end))})
+	if err != nil {
+		return 0, err
+	}
+	defer get.Body.Close()
+	n, err := io.Copy(io.Discard, get.Body)
+	if err == nil && n < end-start+1 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, &bodyReadError{err}
+	}
+	return n, nil
+}
+
+// ObjectChecker hashes object data as it is read, from S3 or from a download,
+// and compares it with what S3 holds for the object: the full-object
+// x-amz-checksum-* values, and the ETag when it is an MD5 of the content,
+// whole or per part for multipart uploads. Multipart ETags are computed for
+// every part size that could have made them at once, so the data is only
+// read one time.
+type ObjectChecker struct {
+	checksums map[string]string
+	hashes    map[string]hash.Hash
+	etag      string
+	partCount int64
+	// partSizeKnown is set when S3 reported the size of part 1, so a
+	// multipart ETag that does not match is a mismatch and not a guess.
+	partSizeKnown bool
+	multipart     []*multipartHasher
+}
+
+// NewObjectChecker sets up the checks for key from its HEAD, which must be
+// made with checksum mode enabled for the checksums to be there. For a
+// multipart upload the size of part 1 is asked for; without it the part size
+// is guessed, and a guess that does not match leaves the ETag unchecked.
+func NewObjectChecker(svc *s3.S3, bucket string, key string, versionId string, head *s3.HeadObjectOutput) *ObjectChecker {
+	checker := &ObjectChecker{checksums: map[string]string{}, hashes: map[string]hash.Hash{}}
+	size := aws.Int64Value(head.ContentLength)
+	// composite checksums of multipart uploads end in -N and are not checked
+	for name, value := range map[string]*string{
+		"sha256": head.ChecksumSHA256,
+		"sha1":   head.ChecksumSHA1,
+		"crc32":  head.ChecksumCRC32,
+		"crc32c": head.ChecksumCRC32C} {
+		if value == nil || strings.Contains(*value, "-") {
+			continue
+		}
+		checker.checksums[name] = *value
+		switch name {
+		case "sha256":
+			checker.hashes[name] = sha256.New()
+		case "sha1":
+			checker.hashes[name] = sha1.New()
+		case "crc32":
+			checker.hashes[name] = crc32.NewIEEE()
+		case "crc32c":
+			checker.hashes[name] = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		}
+	}
+
+	etag := strings.Trim(aws.StringValue(head.ETag), "\"")
+	// the ETag of an object encrypted with KMS or a customer key is not an MD5
+	if len(etag) == 0 || head.SSECustomerAlgorithm != nil ||
+		aws.StringValue(head.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms {
+		return checker
+	}
+	dash := strings.LastIndex(etag, "-")
+	if dash < 0 {
+		checker.etag = etag
+		checker.hashes["md5"] = md5.New()
+		return checker
+	}
+	partCount, _ := strconv.ParseInt(etag[dash+1:], 10, 64)
+	if partCount < 1 {
+		return checker
+	}
+	checker.etag, checker.partCount = etag, partCount
+
+	candidates := []int64{}
+	part, err := svc.HeadObject(
+		&s3.HeadObjectInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			VersionId:  optionalString(versionId),
+			PartNumber: aws.Int64(1)})
+	if err == nil && aws.Int64Value(part.ContentLength) > 0 {
+		checker.partSizeKnown = true
+		candidates = append(candidates, aws.Int64Value(part.ContentLength))
+	} else {
+		const mb = 1024 * 1024
+		evenSplit := (size + partCount - 1) / partCount
+		candidates = append(candidates, (evenSplit+mb-1)/mb*mb)
+		for _, common := range commonPartSizesMB {
+			candidates = append(candidates, common*mb)
+		}
+	}
+	seen := map[int64]bool{}
+	for _, partSize := range candidates {
+		if seen[partSize] || (size+partSize-1)/partSize != partCount {
+			continue
+		}
+		seen[partSize] = true
+		checker.multipart = append(checker.multipart, &multipartHasher{partSize: partSize, part: md5.New()})
+	}
+	return checker
+}
+
+func (checker *ObjectChecker) Write(p []byte) (int, error) {
+	for _, h := range checker.hashes {
+		h.Write(p)
+	}
+	for _, m := range checker.multipart {
+		m.Write(p)
+	}
+	return len(p), nil
+}
+
+// Verify compares what was written with the object's checksums and ETag. It
+// returns the checks made, a note on what could not be checked, and an error
+// if the data does not match.
+func (checker *ObjectChecker) Verify() ([]string, string, error) {
+	checks := []string{}
+	mismatches := []string{}
+	names := make([]string, 0, len(checker.hashes))
+	for name := range checker.hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		checks = append(checks, name)
+		if name == "md5" {
+			if actual := hex.EncodeToString(checker.hashes[name].Sum(nil)); actual != checker.etag {
+				mismatches = append(mismatches, fmt.Sprintf("md5 expected %s got %s", checker.etag, actual))
+			}
+			continue
+		}
+		actual := base64.StdEncoding.EncodeToString(checker.hashes[name].Sum(nil))
+		if expected := checker.checksums[name]; actual != expected {
+			mismatches = append(mismatches, fmt.Sprintf("%s expected %s got %s", name, expected, actual))
+		}
+	}
+
+	note := ""
+	if checker.partCount > 0 {
+		var actual string
+		for _, m := range checker.multipart {
+			actual = m.sum()
+			if actual == checker.etag {
+				checks = append(checks, fmt.Sprintf("multipart-md5/%d", m.partSize))
+				break
+			}
+		}
+		switch {
+		case len(checker.multipart) == 0:
+			note = fmt.Sprintf("multipart-md5 part size of %d part upload unknown", checker.partCount)
+		case actual == checker.etag:
+		case checker.partSizeKnown:
+			checks = append(checks, fmt.Sprintf("multipart-md5/%d", checker.multipart[0].partSize))
+			mismatches = append(mismatches, fmt.Sprintf("multipart-md5 expected %s got %s", checker.etag, actual))
+		default:
+			// a guessed part size that does not match says nothing about the data
+			note = fmt.Sprintf("multipart-md5 part size of %d part upload unknown, no guessed size matched", checker.partCount)
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return checks, note, &checksumMismatchError{strings.Join(mismatches, "; ")}
+	}
+	return checks, note, nil
+}
+
+// multipartHasher computes the ETag of a multipart upload with one part size.
+type multipartHasher struct {
+	partSize int64
+	inPart   int64
+	part     hash.Hash
+	digests  []byte
+	parts    int
+}
+
+func (m *multipartHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := m.partSize - m.inPart
+		if int64(len(p)) < take {
+			take = int64(len(p))
+		}
+		m.part.Write(p[:take])
+		m.inPart += take
+		p = p[take:]
+		if m.inPart == m.partSize {
+			m.endPart()
+		}
+	}
+	return n, nil
+}
+
+func (m *multipartHasher) endPart() {
+	m.digests = append(m.digests, m.part.Sum(nil)...)
+	m.parts++
+	m.part.Reset()
+	m.inPart = 0
+}
+
+func (m *multipartHasher) sum() string {
+	if m.inPart > 0 {
+		m.endPart()
+	}
+	sum := md5.Sum(m.digests)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), m.parts)
+}
@@ -0,0 +1,228 @@
+package client
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// multipartETag is the ETag S3 gives data uploaded in parts of partSize.
+func multipartETag(data []byte, partSize int) string {
+	digests := []byte{}
+	parts := 0
+	for start := 0; start < len(data); start += partSize {
+		end := start + partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := md5.Sum(data[start:end])
+		digests = append(digests, sum[:]...)
+		parts++
+	}
+	sum := md5.Sum(digests)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts)
+}
+
+// fakeObjectServer serves one object uploaded in parts of partSize, and
+// reports that part size for HEAD with partNumber=1.
+func fakeObjectServer(t *testing.T, data []byte, partSize int) (*s3.S3, func()) {
+	etag := "\"" + multipartETag(data, partSize) + "\""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		switch {
+		case r.Method == http.MethodHead && r.URL.Query().Get("partNumber") == "1":
+			w.Header().Set("Content-Length", strconv.Itoa(partSize))
+		case r.Method == http.MethodHead:
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		case r.Header.Get("If-Match") != "" && r.Header.Get("If-Match") != etag:
+			w.WriteHeader(http.StatusPreconditionFailed)
+		default:
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data)
+		}
+	}))
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:       aws.Int(0)}))
+	return s3.New(sess), server.Close
+}
+
+// A multipart ETag needs a HEAD for the part size; with one request slot that
+// HEAD must not wait on the GET whose body holds the slot.
+func TestReadFullWithOneSlot(t *testing.T) {
+	data := []byte("0123456789")
+	svc, closeServer := fakeObjectServer(t, data, 6)
+	defer closeServer()
+	NewLimiter(0, 0, 1, 5*time.Second).Install(svc.Client)
+
+	type result struct {
+		success bool
+		checks  []string
+		read    int64
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		success, checks, read, err := ReadFull(svc, "bucket", "key", "")
+		done <- result{success, checks, read, err}
+	}()
+	select {
+	case got := <-done:
+		if !got.success || got.err != nil || got.read != int64(len(data)) {
+			t.Fatalf("ReadFull = %v, %v, %d, %v; want success reading %d bytes", got.success, got.checks, got.read, got.err, len(data))
+		}
+		if len(got.checks) != 1 || got.checks[0] != "multipart-md5/6" {
+			t.Errorf("ReadFull checks = %v, want [multipart-md5/6]", got.checks)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("ReadFull did not return with a limit of one request in flight")
+	}
+}
+
+// partSizeServer answers HEAD with partNumber=1 with partSize, or 404 when it
+// is 0 as S3 does for objects it has lost the part layout of.
+func partSizeServer(t *testing.T, partSize int) (*s3.S3, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Query().Get("partNumber") != "1" || partSize == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(partSize))
+	}))
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:       aws.Int(0)}))
+	return s3.New(sess), server.Close
+}
+
+func TestObjectCheckerMultipartETag(t *testing.T) {
+	const mb = 1024 * 1024
+	small := []byte("0123456789")
+	large := make([]byte, 12*mb)
+	for i := range large {
+		large[i] = byte(i*7 + i/251)
+	}
+	altered := func(data []byte) []byte {
+		changed := append([]byte{}, data...)
+		changed[len(changed)-1]++
+		return changed
+	}
+	md5Hex := func(data []byte) string {
+		sum := md5.Sum(data)
+		return hex.EncodeToString(sum[:])
+	}
+
+	tests := []struct {
+		name string
+		// uploaded is the object S3 holds, written what the checker is given
+		uploaded []byte
+		written  []byte
+		etag     string
+		// reportedPartSize is what HEAD of part 1 says, 0 for a 404
+		reportedPartSize int
+		kms              bool
+		wantChecks       []string
+		wantNote         string
+		wantMismatch     bool
+	}{
+		{name: "single part", uploaded: small, written: small, etag: md5Hex(small),
+			wantChecks: []string{"md5"}},
+		{name: "single part altered", uploaded: small, written: altered(small), etag: md5Hex(small),
+			wantChecks: []string{"md5"}, wantMismatch: true},
+		{name: "known part size", uploaded: small, written: small, etag: multipartETag(small, 6), reportedPartSize: 6,
+			wantChecks: []string{"multipart-md5/6"}},
+		{name: "known part size, one byte parts", uploaded: small, written: small, etag: multipartETag(small, 1), reportedPartSize: 1,
+			wantChecks: []string{"multipart-md5/1"}},
+		{name: "known part size altered", uploaded: small, written: altered(small), etag: multipartETag(small, 6), reportedPartSize: 6,
+			wantChecks: []string{"multipart-md5/6"}, wantMismatch: true},
+		{name: "known part size truncated", uploaded: small, written: small[:9], etag: multipartETag(small, 6), reportedPartSize: 6,
+			wantChecks: []string{"multipart-md5/6"}, wantMismatch: true},
+		{name: "known part size that cannot make the part count", uploaded: small, written: small, etag: multipartETag(small, 6), reportedPartSize: 3,
+			wantChecks: []string{}, wantNote: "part size of 2 part upload unknown"},
+		{name: "guessed common size", uploaded: large, written: large, etag: multipartETag(large, 5*mb),
+			wantChecks: []string{"multipart-md5/5242880"}},
+		{name: "guessed even split", uploaded: large, written: large, etag: multipartETag(large, 4*mb),
+			wantChecks: []string{"multipart-md5/4194304"}},
+		{name: "guessed size altered", uploaded: large, written: altered(large), etag: multipartETag(large, 5*mb),
+			wantChecks: []string{}, wantNote: "no guessed size matched"},
+		{name: "no guess matches", uploaded: large, written: large, etag: multipartETag(large, 7*mb),
+			wantChecks: []string{}, wantNote: "no guessed size matched"},
+		{name: "kms etag is not an md5", uploaded: small, written: altered(small), etag: multipartETag(small, 6), reportedPartSize: 6, kms: true,
+			wantChecks: []string{}},
+	}
+	for _, test := range tests {
+		svc, closeServer := partSizeServer(t, test.reportedPartSize)
+		head := &s3.HeadObjectOutput{
+			ContentLength: aws.Int64(int64(len(test.uploaded))),
+			ETag:          aws.String("\"" + test.etag + "\"")}
+		if test.kms {
+			head.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		}
+		checker := NewObjectChecker(svc, "bucket", "key", "", head)
+		closeServer()
+		// odd sized writes so parts end part way through a write
+		for data := test.written; len(data) > 0; {
+			n := 65539
+			if n > len(data) {
+				n = len(data)
+			}
+			if len(test.written) < 100 {
+				n = 1
+			}
+			checker.Write(data[:n])
+			data = data[n:]
+		}
+		checks, note, err := checker.Verify()
+		if !reflect.DeepEqual(checks, test.wantChecks) {
+			t.Errorf("%s: checks = %v, want %v", test.name, checks, test.wantChecks)
+		}
+		if (len(test.wantNote) == 0) != (len(note) == 0) || !strings.Contains(note, test.wantNote) {
+			t.Errorf("%s: note = %q, want %q", test.name, note, test.wantNote)
+		}
+		if _, mismatch := err.(*checksumMismatchError); mismatch != test.wantMismatch || (err != nil && !mismatch) {
+			t.Errorf("%s: error = %v, want a mismatch %v", test.name, err, test.wantMismatch)
+		}
+	}
+}
+
+func TestObjectCheckerChecksums(t *testing.T) {
+	data := []byte("0123456789")
+	sum := sha256.Sum256(data)
+	svc, closeServer := partSizeServer(t, 0)
+	defer closeServer()
+	for _, written := range [][]byte{data, []byte("0123456780")} {
+		checker := NewObjectChecker(svc, "bucket", "key", "", &s3.HeadObjectOutput{
+			ContentLength:  aws.Int64(int64(len(data))),
+			ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+			// composite checksums of multipart uploads cannot be checked
+			ChecksumCRC32: aws.String("AAAAAA==-2")})
+		checker.Write(written)
+		checks, _, err := checker.Verify()
+		if !reflect.DeepEqual(checks, []string{"sha256"}) {
+			t.Errorf("%q: checks = %v, want [sha256]", written, checks)
+		}
+		if _, mismatch := err.(*checksumMismatchError); mismatch != (string(written) != string(data)) {
+			t.Errorf("%q: error = %v", written, err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package commands
 import (
     "flag"
     "os"
+    "time"
 )
 
 // Represents the parsed command line arguments that we may be interested in.
@@ -18,6 +19,66 @@ type Arguments struct {
     NoVerifySSL bool
     DeleteOnFail bool
     OutputFile string
+    Tier string
+    Days int64
+    Concurrency int
+    JobFile string
+    VaultEndpoint string
+    Vault string
+    AccountId string
+    JobId string
+    ArchiveId string
+    ArchiveList string
+    OutDir string
+    StripPrefix string
+    OnCollision string
+    PartSizeMB int64
+    PartConcurrency int
+    PartAttempts int
+    Verify bool
+    VerifyReport string
+    EstimatedBandwidthMB int64
+    ExtendRestore bool
+    PollInterval time.Duration
+    PollJitter time.Duration
+    PollRate float64
+    WaitTimeout time.Duration
+    Manifest string
+    ManifestFormat string
+    ManifestColumn string
+    ManifestVersionColumn string
+    InventoryReport string
+    StorageClass string
+    MinSize string
+    MaxSize string
+    ModifiedAfter string
+    ModifiedBefore string
+    Include string
+    Exclude string
+    IncludeRegex string
+    ExcludeRegex string
+    Format string
+    Versions bool
+    VersionId string
+    DeleteMarker bool
+    Quarantine string
+    QuarantineBucket string
+    QuarantinePrefix string
+    Plan string
+    PlanKeyFile string
+    DeleteCategories string
+    MaxAttempts int
+    RetryDelay time.Duration
+    ThrottleDelay time.Duration
+    MaxRetryDelay time.Duration
+    MaxRequestRate float64
+    MaxBandwidth string
+    Adaptive bool
+    TargetLatency time.Duration
+    Ordered bool
+    DeepVerify string
+    Samples int
+    SampleSize string
 }
 
 func ParseArgs() (*Arguments, error) {
@@ -34,6 +95,66 @@ func ParseArgs() (*Arguments, error) {
     noVerifySslParam := flag.Bool("no-verify-ssl", false, "True to allow self-signed certificates")
     deleteOnFailParam := flag.Bool("delete-on-fail", false, "True to delete on get_object_byte fails")
     outputFile:= flag.String("out", "", "output file path")
+    tierParam := flag.String("tier", "Standard", "Restore tier: Expedited, Standard or Bulk (Expedited is not available for DEEP_ARCHIVE)")
+    daysParam := flag.Int64("days", 1, "Number of days to keep the restored copy")
+    jobParam := flag.String("job", "", "Job file recording restore_from_glacier progress, used by resume")
+    vaultEndpointParam := flag.String("vault-endpoint", "", "Specifies the url to the Glacier service for vault commands (default AWS).")
+    vaultParam := flag.String("vault", "", "Glacier vault name.")
+    accountIdParam := flag.String("account-id", "-", "Glacier account id, - for the account of the credentials.")
+    jobIdParam := flag.String("job-id", "", "Existing Glacier job id to use instead of initiating a new job.")
+    archiveIdParam := flag.String("archive-id", "", "Glacier archive id.")
+    archiveListParam := flag.String("archive-list", "", "File of archive ids to retrieve, one per line with an optional description column.")
+    outDirParam := flag.String("out-dir", "", "Directory to download into, recreating the key's prefix structure (default: file name only, in the current directory)")
+    stripPrefixParam := flag.String("strip-prefix", "", "Leading part of the key left out of the path under out-dir")
+    onCollisionParam := flag.String("on-collision", "overwrite", "What to do when the download file exists: skip, overwrite or rename")
+    partSizeParam := flag.Int64("part-size", defaultPartSizeMB, "Part size in MB; larger objects are downloaded as concurrent byte ranges")
+    partConcurrencyParam := flag.Int("part-concurrency", defaultPartConcurrency, "Number of parts of one object downloaded at once")
+    partAttemptsParam := flag.Int("part-attempts", defaultPartAttempts, "Number of times a failed part is tried before the download fails")
+    verifyParam := flag.Bool("verify", true, "Check downloads against the object's ETag and x-amz-checksum-* headers")
+    verifyReportParam := flag.String("verify-report", "", "File to write per-object verification results to (.json for JSON, otherwise CSV)")
+    bandwidthParam := flag.Int64("est-bandwidth", defaultEstimatedBandwidthMB, "Expected download rate in MB/s, used to warn when restored copies expire before they are downloaded")
+    extendRestoreParam := flag.Bool("extend-restore", false, "Re-issue restore for copies expected to expire before they are downloaded")
+    pollIntervalParam := flag.Duration("poll-interval", defaultPollInterval, "Time between checks on pending restores and vault jobs")
+    pollJitterParam := flag.Duration("poll-jitter", defaultPollJitter, "Random amount added to or taken from each poll interval")
+    pollRateParam := flag.Float64("poll-rate", defaultPollRate, "Maximum HEAD requests per second while polling restores (0 for no limit)")
+    waitTimeoutParam := flag.Duration("wait-timeout", defaultWaitTimeout, "Give up waiting on restores after this long (0 to wait forever)")
+    manifestParam := flag.String("manifest", "", "File listing the keys to act on, - for stdin")
+    manifestFormatParam := flag.String("manifest-format", "auto", "Manifest format: auto (csv for .csv files, otherwise text), csv, text or s3-inventory")
+    manifestColumnParam := flag.String("manifest-column", "", "CSV manifest key column, by header name or 1-based index (default Key, or the first column)")
+    manifestVersionColumnParam := flag.String("manifest-version-column", "", "CSV manifest version id column, by header name or 1-based index")
+    inventoryReportParam := flag.String("inventory-report", "", "S3 Inventory manifest.json to list objects from: s3://bucket/path/manifest.json or a local directory")
+    storageClassParam := flag.String("storage-class", "", "Only objects in these storage classes, comma separated (GLACIER,DEEP_ARCHIVE,STANDARD...)")
+    minSizeParam := flag.String("min-size", "", "Only objects at least this size (bytes, or with KB, MB, GB, TB)")
+    maxSizeParam := flag.String("max-size", "", "Only objects at most this size (bytes, or with KB, MB, GB, TB)")
+    modifiedAfterParam := flag.String("modified-after", "", "Only objects last modified after this date (2006-01-02 or RFC3339)")
+    modifiedBeforeParam := flag.String("modified-before", "", "Only objects last modified before this date (2006-01-02 or RFC3339)")
+    includeParam := flag.String("include", "", "Only keys matching these glob patterns, comma separated; patterns without / match the file name")
+    excludeParam := flag.String("exclude", "", "Skip keys matching these glob patterns, comma separated; patterns without / match the file name")
+    includeRegexParam := flag.String("include-regex", "", "Only keys matching this regular expression")
+    excludeRegexParam := flag.String("exclude-regex", "", "Skip keys matching this regular expression")
+    formatParam := flag.String("format", "", "Output format for listings and reports: csv, json (array) or ndjson; default from the output file extension, else csv")
+    versionsParam := flag.Bool("versions", false, "List every version of the objects under --prefix (ListObjectVersions) instead of only the latest")
+    versionIdParam := flag.String("version-id", "", "Act on this version of --key")
+    deleteMarkerParam := flag.Bool("delete-marker", false, "In a versioned bucket, delete keys without a version id by adding a delete marker")
+    quarantineParam := flag.String("quarantine", "", "Set aside objects failing test_byte_restore instead of deleting: tag, copy (marker with metadata, removed on purge) or move (marker with metadata, kept as a record on purge)")
+    quarantineBucketParam := flag.String("quarantine-bucket", "", "Bucket for quarantine markers (default --bucket)")
+    quarantinePrefixParam := flag.String("quarantine-prefix", "", "Prefix for quarantine markers")
+    planParam := flag.String("plan", "", "test_byte_restore writes the objects it would delete to this plan file; apply_plan deletes them")
+    planKeyFileParam := flag.String("plan-key-file", "", "File holding a secret to sign plans with HMAC-SHA256 instead of a plain SHA-256 checksum")
+    deleteCategoriesParam := flag.String("delete-categories", "data-missing", "test_byte_restore failure categories that may be deleted, quarantined or planned: data-missing, archived, permission, throttled, transient-network, unknown")
+    maxAttemptsParam := flag.Int("max-attempts", 5, "Attempts for each S3 request before giving up on throttling, 5xx and network errors")
+    retryDelayParam := flag.Duration("retry-delay", 200 * time.Millisecond, "Delay before the first retry, doubled for each retry after, with jitter")
+    throttleDelayParam := flag.Duration("throttle-delay", 2 * time.Second, "Delay before the first retry of a throttled request (SlowDown, RequestLimitExceeded, ServiceUnavailable)")
+    maxRetryDelayParam := flag.Duration("max-retry-delay", 30 * time.Second, "Longest delay between retries")
+    maxRequestRateParam := flag.Float64("max-rps", 0, "Most S3 requests per second, retries included, 0 for no limit")
+    maxBandwidthParam := flag.String("max-bandwidth", "", "Most data read per second, e.g. 50MB, empty for no limit")
+    adaptiveParam := flag.Bool("adaptive", false, "True to cut the requests in flight when the endpoint throttles or slows down, and raise them again when it recovers")
+    targetLatencyParam := flag.Duration("target-latency", 5 * time.Second, "With --adaptive, the response time, reading the data included, above which requests in flight are cut")
+    orderedParam := flag.Bool("ordered", true, "True to write test_byte_restore results in listing order, false to write each as soon as it is tested")
+    deepVerifyParam := flag.String("deep-verify", "", "test_byte_restore reads the whole object and checks its checksum or ETag (full), or reads ranges spread across it (sample), instead of the first bytes")
+    samplesParam := flag.Int("samples", 8, "Ranges read from each object with --deep-verify sample")
+    sampleSizeParam := flag.String("sample-size", "1MB", "Size of each range read with --deep-verify sample")
+    concurrencyParam := flag.Int("concurrency", defaultConcurrency, "Maximum number of objects processed at once by bulk commands")
     flag.Parse()
 
     // Build the arguments object.
@@ -50,6 +171,66 @@ func ParseArgs() (*Arguments, error) {
         NoVerifySSL: *noVerifySslParam,
         DeleteOnFail: *deleteOnFailParam,
         OutputFile: *outputFile,
+        Tier: *tierParam,
+        Days: *daysParam,
+        Concurrency: *concurrencyParam,
+        JobFile: *jobParam,
+        VaultEndpoint: *vaultEndpointParam,
+        Vault: *vaultParam,
+        AccountId: *accountIdParam,
+        JobId: *jobIdParam,
+        ArchiveId: *archiveIdParam,
+        ArchiveList: *archiveListParam,
+        OutDir: *outDirParam,
+        StripPrefix: *stripPrefixParam,
+        OnCollision: *onCollisionParam,
+        PartSizeMB: *partSizeParam,
+        PartConcurrency: *partConcurrencyParam,
+        PartAttempts: *partAttemptsParam,
+        Verify: *verifyParam,
+        VerifyReport: *verifyReportParam,
+        EstimatedBandwidthMB: *bandwidthParam,
+        ExtendRestore: *extendRestoreParam,
+        PollInterval: *pollIntervalParam,
+        PollJitter: *pollJitterParam,
+        PollRate: *pollRateParam,
+        WaitTimeout: *waitTimeoutParam,
+        Manifest: *manifestParam,
+        ManifestFormat: *manifestFormatParam,
+        ManifestColumn: *manifestColumnParam,
+        ManifestVersionColumn: *manifestVersionColumnParam,
+        InventoryReport: *inventoryReportParam,
+        StorageClass: *storageClassParam,
+        MinSize: *minSizeParam,
+        MaxSize: *maxSizeParam,
+        ModifiedAfter: *modifiedAfterParam,
+        ModifiedBefore: *modifiedBeforeParam,
+        Include: *includeParam,
+        Exclude: *excludeParam,
+        IncludeRegex: *includeRegexParam,
+        ExcludeRegex: *excludeRegexParam,
+        Format: *formatParam,
+        Versions: *versionsParam,
+        VersionId: *versionIdParam,
+        DeleteMarker: *deleteMarkerParam,
+        Quarantine: *quarantineParam,
+        QuarantineBucket: *quarantineBucketParam,
+        QuarantinePrefix: *quarantinePrefixParam,
+        Plan: *planParam,
+        PlanKeyFile: *planKeyFileParam,
+        DeleteCategories: *deleteCategoriesParam,
+        MaxAttempts: *maxAttemptsParam,
+        RetryDelay: *retryDelayParam,
+        ThrottleDelay: *throttleDelayParam,
+        MaxRetryDelay: *maxRetryDelayParam,
+        MaxRequestRate: *maxRequestRateParam,
+        MaxBandwidth: *maxBandwidthParam,
+        Adaptive: *adaptiveParam,
+        TargetLatency: *targetLatencyParam,
+        Ordered: *orderedParam,
+        DeepVerify: *deepVerifyParam,
+        Samples: *samplesParam,
+        SampleSize: *sampleSizeParam,
     }
     return &args, nil
 }
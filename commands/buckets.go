@@ -1,39 +1,27 @@
 package commands
 
 import (
-    "bufio"
-    "bytes"
-    "encoding/csv"
+    "errors"
     "fmt"
     "github.com/SpectraLogic/glacier_recover/client"
     "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/awserr"
     "github.com/aws/aws-sdk-go/service/s3"
-    "io"
-    "log"
     "os"
-    "path"
-    "sync"
+    "strings"
     "time"
 )
 
 
 func getBucketList(svc *s3.S3, args *Arguments) error {
-    outputFile := args.OutputFile
-    wOut := os.Stdout
-    if len(outputFile) > 0 {
-        f, err := os.Create(outputFile)
-        if err != nil {
-            return fmt.Errorf("Could not create %s\n%v\n", outputFile, err)
-        }
-        defer f.Close()
-        wOut = f
+    report, err := newReportWriter(args.OutputFile, args.Format, client.ListBucketsColumns)
+    if err != nil {
+        return err
     }
-    w := csv.NewWriter(wOut)
-    defer w.Flush()
+    defer report.Close()
 
-    vail := &client.VailClient{ svc, w, "", "", false}
+    vail := &client.VailClient{Client: svc, Out: report}
 
-    vail.PrintListBucketsCsvHeader()
     bucketList, err := svc.ListBuckets(nil)
     if err == nil {
         return vail.PrintBucketList(bucketList.Buckets)
@@ -42,149 +30,423 @@ func getBucketList(svc *s3.S3, args *Arguments) error {
 }
 
 func getBucketInventory(svc *s3.S3, args *Arguments) error {
-    return paginatedBucketInventory(svc, args.Bucket, args.Prefix, args.OutputFile)
-}
-
-func doBucketInventory(svc *s3.S3, bucket string, prefix string) ([]*s3.Object, error) {
-    bucketObjectListResponse, err := svc.ListObjectsV2(
-        &s3.ListObjectsV2Input{
-            Bucket: aws.String(bucket),
-            Prefix: aws.String(prefix)})
-    if err == nil {
-        return bucketObjectListResponse.Contents, nil
+    filter, err := newObjectFilter(args)
+    if err != nil {
+        return err
     }
-    return nil, err
+    if args.Versions {
+        return paginatedVersionInventory(svc, args.Bucket, args.Prefix, args.OutputFile, args.Format, filter)
+    }
+    return paginatedBucketInventory(svc, args.Bucket, args.Prefix, args.OutputFile, args.Format, filter)
 }
 
-
-func paginatedBucketInventory(svc *s3.S3, bucket string, prefix string, outputFile string) error {
-    wOut := os.Stdout
-    if len(outputFile) > 0 {
-        f, err := os.Create(outputFile)
-        if err != nil {
-            return fmt.Errorf("Could not create %s\n%v\n", outputFile, err)
-        }
-        defer f.Close()
-        wOut = f
+// paginatedVersionInventory lists every version and delete marker under
+// prefix. Delete markers have no size or storage class, so only key and date
+// filters can match them.
+func paginatedVersionInventory(svc *s3.S3, bucket string, prefix string, outputFile string, format string, filter *objectFilter) error {
+    report, err := newReportWriter(outputFile, format, client.ObjectVersionsColumns)
+    if err != nil {
+        return err
     }
-    w := csv.NewWriter(wOut)
-    defer w.Flush()
+    defer report.Close()
+
+    vail := &client.VailClient{Client: svc, Out: report, Bucket: bucket, Prefix: prefix}
 
-    vail := &client.VailClient{ svc, w, bucket, prefix, false}
+    return svc.ListObjectVersionsPages(
+        &s3.ListObjectVersionsInput{
+        Bucket: aws.String(bucket),
+        Prefix: aws.String(prefix),
+        MaxKeys: aws.Int64(100)},
+        func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+            versions := page.Versions[:0]
+            for _, version := range page.Versions {
+                if filter.matches(objectEntryFromVersion(version)) {
+                    versions = append(versions, version)
+                }
+            }
+            markers := page.DeleteMarkers[:0]
+            for _, marker := range page.DeleteMarkers {
+                if filter.matches(&objectEntry{Key: aws.StringValue(marker.Key), LastModified: aws.TimeValue(marker.LastModified)}) {
+                    markers = append(markers, marker)
+                }
+            }
+            page.Versions, page.DeleteMarkers = versions, markers
+            return vail.PrintObjectVersionsPage(page, lastPage)
+        })
+}
 
-    err := vail.PrintBucketObjectsCsvHeader()
+func paginatedBucketInventory(svc *s3.S3, bucket string, prefix string, outputFile string, format string, filter *objectFilter) error {
+    report, err := newReportWriter(outputFile, format, client.BucketObjectsColumns)
     if err != nil {
-        return fmt.Errorf("failed printing header %v\n", err)
+        return err
     }
+    defer report.Close()
+
+    vail := &client.VailClient{Client: svc, Out: report, Bucket: bucket, Prefix: prefix}
+
     return svc.ListObjectsV2Pages(
         &s3.ListObjectsV2Input{
         Bucket: aws.String(bucket),
         Prefix: aws.String(prefix),
         MaxKeys: aws.Int64(100)},
-        vail.PrintObjectsPage)
+        func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+            page.Contents = filter.filterObjects(page.Contents)
+            return vail.PrintObjectsPage(page, lastPage)
+        })
 }
 
 func testByteRestore(svc *s3.S3, args *Arguments) error {
-    return doTestByteRestore(svc, args.Bucket, args.Prefix, args.DeleteOnFail, args.OutputFile)
+    filter, err := newObjectFilter(args)
+    if err != nil {
+        return err
+    }
+    var manifest keySource
+    if len(args.Manifest) > 0 || len(args.InventoryReport) > 0 || args.Versions {
+        manifest, err = keySourceFromArgs(svc, args)
+        if err != nil {
+            return err
+        }
+    }
+    return doTestByteRestore(svc, args, manifest, filter)
 }
 
-func doTestByteRestore(svc *s3.S3, bucket string, prefix string, deleteOnFail bool, outputFile string) error {
-    wOut := os.Stdout
-    if len(outputFile) > 0 {
-        f, err := os.Create(outputFile)
-        if err != nil {
-            return fmt.Errorf("Could not create %s\n%v\n", outputFile, err)
+// parseDeleteCategories reads the failure categories that may lead to a
+// delete, by --delete-on-fail, a quarantine purge or a plan.
+func parseDeleteCategories(args *Arguments) (map[string]bool, error) {
+    known := map[string]bool{}
+    for _, category := range client.Categories {
+        known[category] = true
+    }
+    categories := map[string]bool{}
+    for _, category := range strings.Split(args.DeleteCategories, ",") {
+        category = strings.TrimSpace(category)
+        if len(category) == 0 {
+            continue
+        }
+        if !known[category] {
+            return nil, fmt.Errorf("unknown delete category '%s', must be one of %s",
+                category, strings.Join(client.Categories, ", "))
         }
-        defer f.Close()
-        wOut = f
+        categories[category] = true
     }
-    w := csv.NewWriter(wOut)
-    defer w.Flush()
+    return categories, nil
+}
 
-    vail := &client.VailClient{ svc, w, bucket, prefix, deleteOnFail}
+// parseDeepVerify checks the --deep-verify mode and returns the sample size
+// for sampled reads.
+func parseDeepVerify(args *Arguments) (int64, error) {
+    switch args.DeepVerify {
+    case "", client.VerifyFull:
+        return 0, nil
+    case client.VerifySample:
+    default:
+        return 0, fmt.Errorf("--deep-verify must be %s or %s, not '%s'", client.VerifyFull, client.VerifySample, args.DeepVerify)
+    }
+    if args.Samples < 1 {
+        return 0, fmt.Errorf("--samples must be at least 1, got %d", args.Samples)
+    }
+    sampleSize, err := parseSize(args.SampleSize, 0)
+    if err != nil {
+        return 0, fmt.Errorf("invalid --sample-size %v", err)
+    }
+    if sampleSize < 1 {
+        return 0, fmt.Errorf("--sample-size must be at least 1 byte")
+    }
+    return sampleSize, nil
+}
 
-    err := vail.PrintTestRestoreCsvHeader()
+// doTestByteRestore tests every object under --prefix that matches filter, or
+// every object in manifest (a key manifest, inventory report or version
+// listing, already filtered) when one is given.
+func doTestByteRestore(svc *s3.S3, args *Arguments, manifest keySource, filter *objectFilter) error {
+    bucket, prefix := args.Bucket, args.Prefix
+    modes := 0
+    for _, set := range []bool{args.DeleteOnFail, len(args.Quarantine) > 0, len(args.Plan) > 0} {
+        if set {
+            modes++
+        }
+    }
+    if modes > 1 {
+        return fmt.Errorf("use only one of --delete-on-fail, --quarantine or --plan")
+    }
+    deleteCategories, err := parseDeleteCategories(args)
     if err != nil {
-        return fmt.Errorf("failed printing header %v\n", err)
+        return err
     }
+    sampleSize, err := parseDeepVerify(args)
+    if err != nil {
+        return err
+    }
+    q, err := newQuarantine(svc, args)
+    if err != nil {
+        return err
+    }
+    report, err := newReportWriter(args.OutputFile, args.Format, client.TestRestoreColumns)
+    if err != nil {
+        return err
+    }
+    defer report.Close()
 
-    err = svc.ListObjectsV2Pages(
-        &s3.ListObjectsV2Input{
-            Bucket: aws.String(bucket),
-            Prefix: aws.String(prefix),
-            MaxKeys: aws.Int64(100)},
-        vail.HandleTestByteRestore)
+    vail := &client.VailClient{Client: svc, Out: report, Bucket: bucket, Prefix: prefix,
+        DeleteOnFail: args.DeleteOnFail, DeleteMarker: args.DeleteMarker, DeleteCategories: deleteCategories,
+        Verify: args.DeepVerify, Samples: args.Samples, SampleSize: sampleSize}
+    if q != nil {
+        vail.OnFail = q.Quarantine
+    }
+    if len(args.Plan) > 0 {
+        plan, err := newPlanWriter(svc, args)
+        if err != nil {
+            return err
+        }
+        vail.OnFail = plan.Add
+        err = walkTestByteRestore(svc, args, vail, manifest, filter)
+        if closeErr := plan.Close(); err == nil {
+            err = closeErr
+        }
+        return err
+    }
+    if args.DeleteOnFail {
+        if vail.Versioned, err = bucketVersioned(svc, bucket); err != nil {
+            return err
+        }
+        if vail.Versioned && !args.DeleteMarker {
+            fmt.Fprintf(os.Stderr, "Bucket %s is versioned: only objects with a version id (--versions or a manifest version column) are deleted\n", bucket)
+        }
+    }
+    return walkTestByteRestore(svc, args, vail, manifest, filter)
+}
+
+// walkTestByteRestore tests the objects from manifest, or the listing of
+// vail.Prefix when there is none, on a pool of --concurrency testers. With
+// --ordered the report keeps the listing order; otherwise each result is
+// written as soon as it is known.
+func walkTestByteRestore(svc *s3.S3, args *Arguments, vail *client.VailClient, manifest keySource, filter *objectFilter) error {
+    source := manifest
+    if source == nil {
+        source = newPrefixKeySource(svc, vail.Bucket, vail.Prefix)
+        if filter.active() {
+            source = &filteredKeySource{source: source, filter: filter, svc: svc, bucket: vail.Bucket,
+                concurrency: args.Concurrency}
+        }
+    }
+    var ordered *orderedReport
+    if args.Ordered {
+        ordered = newOrderedReport(vail.Out)
+        source = &orderedKeySource{source: source, report: ordered}
+    }
+
+    progress := startProgress("test_byte_restore")
+    _, err := newWorkerPool(args.Concurrency).Run(source, func(object *objectEntry) error {
+        // manifests carry no storage class; never treat a GLACIER object as missing
+        storageClass := object.StorageClass
+        if len(storageClass) == 0 {
+            storageClass, _ = headStorageClass(svc, vail.Bucket, object.Key, object.VersionId)
+        }
+        if ordered == nil {
+            progress.add(!vail.TestByteRestoreVersion(object.Key, object.VersionId, storageClass))
+            return nil
+        }
+        tester := *vail
+        slot := ordered.slot(object)
+        tester.Out = slot
+        progress.add(!tester.TestByteRestoreVersion(object.Key, object.VersionId, storageClass))
+        return slot.Close()
+    })
+    progress.Stop()
     return err
 }
 
-func doRestoreObject(svc *s3.S3, bucket string, key string) error {
-    _, err := svc.RestoreObject(
+// restoreTier validates the requested tier against the storage class of the
+// object. Expedited retrievals are not offered for DEEP_ARCHIVE, so those fall
+// back to Standard.
+func restoreTier(storageClass string, tier string) (string, error) {
+    switch storageClass {
+    case s3.StorageClassGlacier:
+        return tier, nil
+    case s3.StorageClassDeepArchive:
+        if tier == s3.TierExpedited {
+            return s3.TierStandard, nil
+        }
+        return tier, nil
+    default:
+        return "", fmt.Errorf("storage class %s is not restorable", storageClass)
+    }
+}
+
+// parseTier accepts the tier in any case and returns the canonical S3 name.
+func parseTier(tier string) (string, error) {
+    for _, valid := range s3.Tier_Values() {
+        if strings.EqualFold(tier, valid) {
+            return valid, nil
+        }
+    }
+    return "", fmt.Errorf("invalid tier '%s', must be one of %s", tier, strings.Join(s3.Tier_Values(), ", "))
+}
+
+func headStorageClass(svc *s3.S3, bucket string, key string, versionId string) (string, error) {
+    result, err := svc.HeadObject(
+        &s3.HeadObjectInput{
+            Bucket: aws.String(bucket),
+            Key:  aws.String(key),
+            VersionId: optionalString(versionId)})
+    if err != nil {
+        return "", err
+    }
+    // HEAD omits the storage class for STANDARD objects
+    if result.StorageClass == nil {
+        return s3.StorageClassStandard, nil
+    }
+    return *result.StorageClass, nil
+}
+
+func doRestoreObject(svc *s3.S3, bucket string, key string, versionId string, storageClass string, tier string, days int64) error {
+    name := versionName(key, versionId)
+    requestTier, err := restoreTier(storageClass, tier)
+    if err != nil {
+        fmt.Fprintf(statusOut, "Restore request failed: %s %v\n", name, err)
+        return err
+    }
+    _, err = svc.RestoreObject(
         &s3.RestoreObjectInput{
             Bucket: aws.String(bucket),
-            Key:  aws.String(key)})
+            Key:  aws.String(key),
+            VersionId: optionalString(versionId),
+            RestoreRequest: &s3.RestoreRequest{
+                Days: aws.Int64(days),
+                GlacierJobParameters: &s3.GlacierJobParameters{
+                    Tier: aws.String(requestTier)}}})
+    retries := retryNote(svc, key, versionId)
+    if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+        fmt.Fprintf(statusOut, "Restore already in progress: %s %s%s\n", name, time.Now().Format(time.RFC3339), retries)
+        return nil
+    }
     if err == nil {
-        fmt.Printf("Restore requested: %s %s\n", key, time.Now().Format(time.RFC3339))
+        fmt.Fprintf(statusOut, "Restore requested: %s %s %s tier, %d days %s%s\n",
+            name, storageClass, requestTier, days, time.Now().Format(time.RFC3339), retries)
     } else {
-        fmt.Printf("Restore request failed: %s %v\n", key, err)
+        fmt.Fprintf(statusOut, "Restore request failed: %s %v%s\n", name, err, retries)
     }
     return err
 }
 
+// retryNote is how many retries the requests for key needed, for progress
+// lines, or "" when it needed none.
+func retryNote(svc *s3.S3, key string, versionId string) string {
+    retries := client.TakeRetries(svc, key, versionId)
+    if retries == 0 {
+        return ""
+    }
+    return fmt.Sprintf(" (%d retries)", retries)
+}
+
 func restoreObject(svc *s3.S3, args *Arguments) error {
-    if len(args.Key) > 0 {
-        return doRestoreObject(svc, args.Bucket, args.Key)
+    source, err := keySourceFromArgs(svc, args)
+    if err != nil {
+        return err
     }
-    if len(args.Prefix) > 0 {
-        keyList, err := doBucketInventory(svc, args.Bucket, args.Prefix)
-        if err != nil {
-            return fmt.Errorf("failed getting object list %v\n", err)
-        }
-        if len(keyList) == 0 {
-            return fmt.Errorf("no objects match bucket %s and prefix %s,%v\n",
-                args.Bucket, args.Prefix, err)
-        }
-        atLeastOneGood := false
-        for _, key := range keyList {
-            err = doRestoreObject(svc, args.Bucket, *key.Key)
-            if err == nil {
-                atLeastOneGood = true
+    return restoreKeys(svc, args, source, nil)
+}
+
+func restoreKeys(svc *s3.S3, args *Arguments, source keySource, journal *jobJournal) error {
+    tier, err := parseTier(args.Tier)
+    if err != nil {
+        return err
+    }
+    if args.Days < 1 {
+        return fmt.Errorf("days must be at least 1, got %d", args.Days)
+    }
+    result, err := newWorkerPool(args.Concurrency).Run(source, func(object *objectEntry) error {
+        storageClass := object.StorageClass
+        if len(storageClass) == 0 {
+            var err error
+            storageClass, err = headStorageClass(svc, args.Bucket, object.Key, object.VersionId)
+            if err != nil {
+                err = fmt.Errorf("failed getting storage class %v", err)
+                return journalError(journal.Record(object.Key, stateRequested, err), err)
             }
         }
-        if atLeastOneGood {
-            // continue, some restoreObjects have succeeded
-            return nil
+        // copies outside Glacier need no restore, they can be downloaded as is
+        if storageClass != s3.StorageClassGlacier && storageClass != s3.StorageClassDeepArchive {
+            fmt.Fprintf(statusOut, "Not archived, ready for download: %s %s %s\n",
+                versionName(object.Key, object.VersionId), storageClass, time.Now().Format(time.RFC3339))
+            return journal.Record(object.Key, stateReady, nil)
         }
-        return fmt.Errorf("No successful restore commands")
+        err := doRestoreObject(svc, args.Bucket, object.Key, object.VersionId, storageClass, tier, args.Days)
+        return journalError(journal.Record(object.Key, stateRequested, err), err)
+    })
+    if err != nil {
+        return err
     }
-    return fmt.Errorf("Must specify either key or prefix")
+    result.PrintSummary("restore")
+    if len(result.Succeeded) > 0 {
+        // continue, some restoreObjects have succeeded
+        return nil
+    }
+    return fmt.Errorf("No successful restore commands")
+}
+
+// journalError prefers the error from the step itself over a failure to
+// record it.
+func journalError(recordErr error, stepErr error) error {
+    if stepErr != nil {
+        return stepErr
+    }
+    return recordErr
 }
 
 func headObject(svc *s3.S3, args *Arguments) error {
     restoreResponse, err := svc.HeadObject(
         &s3.HeadObjectInput{
             Bucket: aws.String(args.Bucket),
-            Key:  aws.String(args.Key)})
-    if err == nil {
-        fmt.Printf("Restore request: %s\n", *restoreResponse.Restore)
+            Key:  aws.String(args.Key),
+            VersionId: optionalString(args.VersionId)})
+    if err != nil {
+        return err
     }
-    return err
+    status := restoreStatusFromHead(args.Key, restoreResponse)
+    if len(status.VersionId) > 0 {
+        fmt.Fprintf(statusOut, "Version: %s\n", status.VersionId)
+    }
+    if restoreResponse.Restore != nil {
+        fmt.Fprintf(statusOut, "Restore request: %s\n", *restoreResponse.Restore)
+    }
+    fmt.Fprintf(statusOut, "Restore state: %s %s", status.StorageClass, status.State)
+    if !status.Expiry.IsZero() {
+        fmt.Fprintf(statusOut, ", expires %s", status.Expiry.Format(time.RFC3339))
+    }
+    fmt.Fprintf(statusOut, "\n")
+    return status.Err
 }
 
 func getObjectByte(svc *s3.S3, args *Arguments) error {
-    success, err := testGetObject(svc, args.Bucket, args.Key)
-    if err != nil {
-        return fmt.Errorf("could not issue test restore %v\n", err)
+    success, err := client.TestGetObject(svc, args.Bucket, args.Key, args.VersionId)
+    category := client.ClassifyError(err)
+    if !success && category != client.CategoryDataMissing {
+        return fmt.Errorf("could not issue test restore (%s) %v\n", category, err)
     }
     if success {
-        fmt.Printf("SUCCESS test restoring %s\n", args.Key)
+        fmt.Fprintf(statusOut, "SUCCESS test restoring %s\n", args.Key)
     } else {
-        fmt.Printf("FAILED test restoring %s\n", args.Key)
+        fmt.Fprintf(statusOut, "FAILED test restoring %s (%s) %v\n", args.Key, category, err)
     }
     return nil
 }
 
+// deleteObject removes --key, or with --version-id that exact version for
+// good. Deleting a key without a version in a versioned bucket only adds a
+// delete marker, so that needs --delete-marker to show it is meant.
 func deleteObject(svc *s3.S3, args *Arguments) error {
-    err := doDeleteObject(svc, args.Bucket, args.Key)
+    if len(args.VersionId) == 0 {
+        versioned, err := bucketVersioned(svc, args.Bucket)
+        if err != nil {
+            return err
+        }
+        if versioned && !args.DeleteMarker {
+            return fmt.Errorf("bucket %s is versioned: deleting %s would only add a delete marker and keep its data; " +
+                "pass --version-id to remove a version, or --delete-marker to add the marker\n", args.Bucket, args.Key)
+        }
+    }
+    err := doDeleteObject(svc, args.Bucket, args.Key, args.VersionId)
 
     if err != nil {
         return fmt.Errorf("could not issue deleteObject %v\n", err)
@@ -192,125 +454,184 @@ func deleteObject(svc *s3.S3, args *Arguments) error {
     return nil
 }
 
-func getObject(svc *s3.S3, args *Arguments) error {
-    // single object if key is defined
-    if len(args.Key) > 0 {
-        return doGetObject(svc, args.Bucket, args.Key)
-    }
-
-    // all objects in bucket matching prefix
-    if len(args.Prefix) > 0 {
-        keyList, err := doBucketInventory(svc, args.Bucket, args.Prefix)
-        if err != nil {
-            return fmt.Errorf("failed getting object list %v\n", err)
-        }
-        if len(keyList) == 0 {
-            return fmt.Errorf("no objects match bucket %s and prefix %s,%v\n",
-                args.Bucket, args.Prefix, err)
-        }
-        var wg sync.WaitGroup
-        for _, key := range keyList {
-            wg.Add(1)
-
-            go func(name string) {
-                err := doGetObject(svc, args.Bucket, name)
-                if err != nil {
-                    errorDescription := fmt.Sprintf("failed get-object for  '%s'%v\n", *key.Key, err)
-                    log.Printf(errorDescription)
-                    return
-                }
-                wg.Done()
-            }(*key.Key)
-        }
-        wg.Wait()
+// bucketVersioned reports whether versioning is, or has been, turned on for
+// bucket; a suspended bucket keeps its versions.
+func bucketVersioned(svc *s3.S3, bucket string) (bool, error) {
+    result, err := svc.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: aws.String(bucket)})
+    if err != nil {
+        return false, fmt.Errorf("failed getting versioning of bucket %s, %v\n", bucket, err)
     }
-    return nil
+    status := aws.StringValue(result.Status)
+    return status == s3.BucketVersioningStatusEnabled || status == s3.BucketVersioningStatusSuspended, nil
 }
 
-func doGetObject(svc *s3.S3,  bucket string, key string) error {
-    requestInput := &s3.GetObjectInput{
-        Bucket: aws.String(bucket),
-        Key:  aws.String(key),
-    }
-
-    getObjectRequest, getObjectResponse := svc.GetObjectRequest(requestInput)
-    err := getObjectRequest.Send()
+func getObject(svc *s3.S3, args *Arguments) error {
+    source, err := keySourceFromArgs(svc, args)
     if err != nil {
-        return fmt.Errorf("falied to retrieve %s for bucket %s, %v\n",
-            key, bucket, err)
+        return err
     }
+    return getKeys(svc, args, source, nil)
+}
 
-    // Get the last of the key
-    fileName := path.Base(key)
-
-    // Open the file to write.
-    file, fileErr := os.Create(fileName)
-    if fileErr != nil {
-        return fileErr
+func getKeys(svc *s3.S3, args *Arguments, source keySource, journal *jobJournal) error {
+    d, err := newDownloader(svc, args)
+    if err != nil {
+        return err
     }
-    defer file.Close()
-
-    // Copy the request stream to the file.
-    _, err = io.Copy(file, getObjectResponse.Body)
+    defer d.Close()
+    result, err := newWorkerPool(args.Concurrency).Run(source, func(object *objectEntry) error {
+        err := d.Download(object)
+        return journalError(journal.Record(object.Key, stateDownloaded, err), err)
+    })
     if err != nil {
-        return fmt.Errorf("falied to write object %s, %v\n",
-            key, err)
+        return err
+    }
+    result.PrintSummary("get_object")
+    if len(result.Failed) > 0 {
+        return fmt.Errorf("failed get-object for %d objects", len(result.Failed))
     }
-    fmt.Printf("Restored: %s\n", fileName)
     return nil
 }
 
-func testGetObject(svc *s3.S3,  bucket string, key string) (bool, error) {
-    requestInput := &s3.GetObjectInput{
+func doDeleteObject(svc *s3.S3,  bucket string, key string, versionId string) error {
+    requestInput := &s3.DeleteObjectInput{
         Bucket: aws.String(bucket),
         Key:  aws.String(key),
-        Range: aws.String("bytes=0-1"),
+        VersionId: optionalString(versionId),
     }
-    getObjectRequest, getObjectResponse := svc.GetObjectRequest(requestInput)
-    err := getObjectRequest.Send()
+    result, err := svc.DeleteObject(requestInput)
     if err != nil {
-        return false, fmt.Errorf("falied to retrieve %s from bucket %s, %v\n",
-            key, bucket, err)
+        return fmt.Errorf("falied to delete %s from bucket %s, %v\n",
+            versionName(key, versionId), bucket, err)
+    }
+    if aws.BoolValue(result.DeleteMarker) && len(versionId) == 0 {
+        fmt.Fprintf(statusOut, "Delete marker added: %s version %s\n", key, aws.StringValue(result.VersionId))
+    } else {
+        fmt.Fprintf(statusOut, "Deleted: %s\n", versionName(key, versionId))
     }
+    return nil
+}
 
-    // ascertain that data is there
-    var b bytes.Buffer
-    w := bufio.NewWriter(&b)
+// latestVersionsOnly refuses version options for restore_from_glacier and
+// resume, as the job file and restore poller track keys, not versions.
+func latestVersionsOnly(args *Arguments) error {
+    if args.Versions || len(args.VersionId) > 0 || len(args.ManifestVersionColumn) > 0 {
+        return fmt.Errorf("restore_from_glacier works on the latest versions only; use restore and get_object for older versions")
+    }
+    return nil
+}
 
-    _, err = io.Copy(w, getObjectResponse.Body)
-    // return false on error (expected); return error only if communication failed
-    return err == nil, nil
+func restoreFromGlacier(svc *s3.S3, args *Arguments) error {
+    if err := latestVersionsOnly(args); err != nil {
+        return err
+    }
+    var journal *jobJournal
+    if len(args.JobFile) > 0 {
+        var err error
+        journal, err = createJobJournal(args.JobFile, jobHeader{
+            Bucket: args.Bucket,
+            Key: args.Key,
+            Prefix: args.Prefix,
+            Manifest: args.Manifest,
+            ManifestFormat: args.ManifestFormat,
+            ManifestColumn: args.ManifestColumn,
+            ManifestVersionColumn: args.ManifestVersionColumn,
+            InventoryReport: args.InventoryReport,
+            StorageClass: args.StorageClass,
+            MinSize: args.MinSize,
+            MaxSize: args.MaxSize,
+            ModifiedAfter: args.ModifiedAfter,
+            ModifiedBefore: args.ModifiedBefore,
+            Include: args.Include,
+            Exclude: args.Exclude,
+            IncludeRegex: args.IncludeRegex,
+            ExcludeRegex: args.ExcludeRegex,
+            Tier: args.Tier,
+            Days: args.Days,
+            Download: args.Download,
+            Started: time.Now()})
+        if err != nil {
+            return err
+        }
+        defer journal.Close()
+    }
+    return runRestoreJob(svc, args, journal)
 }
 
-func doDeleteObject(svc *s3.S3,  bucket string, key string) error {
-    requestInput := &s3.DeleteObjectInput{
-        Bucket: aws.String(bucket),
-        Key:  aws.String(key),
+// resumeJob continues a restore_from_glacier job from its job file. Keys
+// already requested are not restored again and downloaded keys are skipped.
+func resumeJob(svc *s3.S3, args *Arguments) error {
+    if len(args.JobFile) == 0 {
+        return fmt.Errorf("resume requires --job")
     }
-    _, err := svc.DeleteObject(requestInput)
+    journal, err := openJobJournal(args.JobFile)
     if err != nil {
-        return fmt.Errorf("falied to delete %s from bucket %s, %v\n",
-            key, bucket, err)
-    }
-    return nil
+        return err
+    }
+    defer journal.Close()
+
+    jobArgs := *args
+    jobArgs.Bucket = journal.Header.Bucket
+    jobArgs.Key = journal.Header.Key
+    jobArgs.Prefix = journal.Header.Prefix
+    // a manifest read from stdin has to be supplied again
+    if len(args.Manifest) == 0 {
+        if journal.Header.Manifest == "-" {
+            return fmt.Errorf("job %s read its manifest from stdin, pass it again with --manifest", args.JobFile)
+        }
+        jobArgs.Manifest = journal.Header.Manifest
+        jobArgs.ManifestFormat = journal.Header.ManifestFormat
+        jobArgs.ManifestColumn = journal.Header.ManifestColumn
+        jobArgs.ManifestVersionColumn = journal.Header.ManifestVersionColumn
+    }
+    if len(args.InventoryReport) == 0 {
+        jobArgs.InventoryReport = journal.Header.InventoryReport
+    }
+    // the job keeps the filter it was started with
+    jobArgs.StorageClass = journal.Header.StorageClass
+    jobArgs.MinSize = journal.Header.MinSize
+    jobArgs.MaxSize = journal.Header.MaxSize
+    jobArgs.ModifiedAfter = journal.Header.ModifiedAfter
+    jobArgs.ModifiedBefore = journal.Header.ModifiedBefore
+    jobArgs.Include = journal.Header.Include
+    jobArgs.Exclude = journal.Header.Exclude
+    jobArgs.IncludeRegex = journal.Header.IncludeRegex
+    jobArgs.ExcludeRegex = journal.Header.ExcludeRegex
+    jobArgs.Tier = journal.Header.Tier
+    jobArgs.Days = journal.Header.Days
+    jobArgs.Download = journal.Header.Download
+    if err = latestVersionsOnly(&jobArgs); err != nil {
+        return err
+    }
+    fmt.Fprintf(statusOut, "Resuming job started %s\n", journal.Header.Started.Format(time.RFC3339))
+    return runRestoreJob(svc, &jobArgs, journal)
 }
 
-func restoreFromGlacier(svc *s3.S3, args *Arguments) error {
-    // issue restore
-    err := restoreObject(svc, args)
+func runRestoreJob(svc *s3.S3, args *Arguments, journal *jobJournal) error {
+    source, err := keySourceFromArgs(svc, args)
     if err != nil {
+        return err
+    }
+
+    // issue restore
+    err = restoreKeys(svc, args, journal.Pending(source, stateNone, stateRequested), journal)
+    if err != nil && journal == nil {
         return fmt.Errorf("failed restore request %v\n", err)
     }
 
     // wait until restore completes
-    err = waitOnHead(svc, args)
-    if err != nil {
+    err = waitOnKeys(svc, args, journal.Pending(source, stateRequested, stateReady), journal)
+    if err != nil && journal == nil {
         return fmt.Errorf("failed to restore %s, %v\n", args.Key, err)
     }
 
-    // download if requested
+    // download if requested, the copies closest to expiry first
     if args.Download == true {
-        err = getObject(svc, args)
+        scheduled, err := scheduleDownloads(svc, args, journal.Pending(source, stateReady, stateDownloaded), journal)
+        if err != nil {
+            return fmt.Errorf("failed to schedule downloads, %v\n", err)
+        }
+        err = getKeys(svc, args, scheduled, journal)
         if err != nil {
             return fmt.Errorf("failed to download %s, %v\n", args.Key, err)
         }
@@ -318,74 +639,52 @@ func restoreFromGlacier(svc *s3.S3, args *Arguments) error {
     return nil
 }
 
-const maxInterval = 89
 func waitOnHead(svc *s3.S3, args *Arguments) error {
-    // single object if key is defined
-    if len(args.Key) > 0 {
-        fmt.Printf("Watching: %s %s\n", args.Key, time.Now().Format(time.RFC3339))
-        err := doWaitOnHead(svc, args.Bucket, args.Key, 0, 1)
-        if err != nil {
-            return fmt.Errorf("failed waiting for  '%s'%v\n", args.Key, err)
-        }
-        fmt.Printf("Ready for download: %s %s\n", args.Key, time.Now().Format(time.RFC3339))
-    }
-
-    // all objects in bucket matching prefix
-    if len(args.Prefix) > 0 {
-        keyList, err := doBucketInventory(svc, args.Bucket, args.Prefix)
-        if err != nil {
-            return fmt.Errorf("failed getting object list %v\n", err)
-        }
-        if len(keyList) == 0 {
-            return fmt.Errorf("no objects match bucket %s and prefix %s,%v\n",
-                args.Bucket, args.Prefix, err)
-        }
-        atLeastOneGood := false
-        var wg sync.WaitGroup
-
-        for _, key := range keyList {
-            wg.Add(1)
-
-            go func(name string) {
-                fmt.Printf("Watching: %s %s\n", name, time.Now().Format(time.RFC3339))
-                err := doWaitOnHead(svc, args.Bucket, name, 0, 1)
-                if err != nil {
-                    errorDescription := fmt.Sprintf("failed waiting for  '%s'%v\n", name, err)
-                    log.Printf(errorDescription)
-                    return
-                } else {
-                    atLeastOneGood = true
-                }
-                wg.Done()
-                fmt.Printf("Ready for download: %s %s\n", name, time.Now().Format(time.RFC3339))
-            }(*key.Key)
-        }
-        wg.Wait()
-        if !atLeastOneGood {
-            return fmt.Errorf("no matching objects ready for restoration")
-        }
+    source, err := keySourceFromArgs(svc, args)
+    if err != nil {
+        return err
     }
-    return nil
+    return waitOnKeys(svc, args, source, nil)
 }
 
-func doWaitOnHead(svc *s3.S3, bucket string, key string, fib1 int, fib2 int) error {
-    result, err := svc.HeadObject(
-        &s3.HeadObjectInput{
-            Bucket: aws.String(bucket),
-            Key:  aws.String(key)})
+func waitOnKeys(svc *s3.S3, args *Arguments, source keySource, journal *jobJournal) error {
+    result := &poolResult{}
+    keys := []string{}
+    err := source.Walk(func(object *objectEntry) error {
+        if object.LookupErr != nil {
+            result.add(object.Key, journalError(journal.Record(object.Key, stateReady, object.LookupErr), object.LookupErr))
+            return nil
+        }
+        keys = append(keys, object.Key)
+        return nil
+    })
     if err != nil {
-        return fmt.Errorf("Head object failed: %v\n", err)
+        return err
+    }
+    fmt.Fprintf(statusOut, "Watching: %d keys %s\n", len(keys), time.Now().Format(time.RFC3339))
+
+    pending := newRestorePoller(svc, args).Wait(keys,
+        func(key string) {
+            fmt.Fprintf(statusOut, "Ready for download: %s %s\n", key, time.Now().Format(time.RFC3339))
+            result.add(key, journal.Record(key, stateReady, nil))
+        },
+        func(key string, err error) {
+            if errors.Is(err, errNoRestore) {
+                // the restored copy expired, resume has to request it again
+                result.add(key, journalError(journal.Reset(key, err), err))
+                return
+            }
+            result.add(key, journalError(journal.Record(key, stateReady, err), err))
+        })
+    result.PrintSummary("wait")
+    for _, key := range pending {
+        fmt.Fprintf(statusOut, "  STILL PENDING %s\n", key)
     }
-    if *result.Restore != "ongoing-request=\"true\""  {
-        return nil
+    if len(pending) > 0 {
+        fmt.Fprintf(statusOut, "wait: %d keys still pending after %s\n", len(pending), args.WaitTimeout)
     }
-    // fibonacci up to maxInterval
-    fib3 := fib1 + fib2
-    if fib3 > maxInterval {
-        fib3 = maxInterval
+    if len(result.Succeeded) == 0 {
+        return fmt.Errorf("no matching objects ready for restoration")
     }
-    time.Sleep(time.Duration(fib3) * time.Second)
-    // fmt.Printf(".")
-
-    return doWaitOnHead(svc, bucket, key, fib2, fib3)
+    return nil
 }
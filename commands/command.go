@@ -2,10 +2,14 @@ package commands
 
 import (
     "fmt"
+    "os"
+    "github.com/SpectraLogic/glacier_recover/client"
+    "github.com/aws/aws-sdk-go/service/glacier"
     "github.com/aws/aws-sdk-go/service/s3"
 )
 
 type command func(*s3.S3, *Arguments) error
+type vaultCommand func(*glacier.Glacier, *Arguments) error
 
 var availableCommands = map[string]command {
     "list_buckets": getBucketList,
@@ -17,15 +21,76 @@ var availableCommands = map[string]command {
     "test_byte_restore": testByteRestore,
     "head_object": headObject,
     "restore_from_glacier": restoreFromGlacier,
+    "resume": resumeJob,
+    "restore_status": restoreStatusReport,
+    "quarantine_review": quarantineReview,
+    "quarantine_purge": quarantinePurge,
+    "apply_plan": applyPlan,
 }
 
-func RunCommand(svc *s3.S3, args *Arguments) error {
-    cmd, ok := availableCommands[args.Command]
-    if ok {
+// reportCommands write their report to stdout unless --out is given.
+var reportCommands = map[string]bool {
+    "list_buckets": true,
+    "inventory": true,
+    "test_byte_restore": true,
+    "restore_status": true,
+    "quarantine_review": true,
+    "quarantine_purge": true,
+    "apply_plan": true,
+    "vault_inventory": true,
+}
+
+var vaultCommands = map[string]vaultCommand {
+    "vault_inventory": vaultInventory,
+    "describe_job": describeVaultJob,
+    "vault_retrieve": vaultRetrieve,
+}
+
+func RunCommand(svc *s3.S3, vaultSvc *glacier.Glacier, args *Arguments) error {
+    if reportCommands[args.Command] && len(args.OutputFile) == 0 {
+        statusOut = os.Stderr
+    }
+    retry := &client.RetryPolicy{MaxAttempts: args.MaxAttempts, BaseDelay: args.RetryDelay,
+        ThrottleDelay: args.ThrottleDelay, MaxDelay: args.MaxRetryDelay}
+    retry.Install(svc.Client)
+    retry.Install(vaultSvc.Client)
+    limiter, err := newLimiter(args)
+    if err != nil {
+        return err
+    }
+    limiter.Install(svc.Client)
+    limiter.Install(vaultSvc.Client)
+    if cmd, ok := availableCommands[args.Command]; ok {
         return cmd(svc, args)
-    } else {
-        return fmt.Errorf("Unsupported command: '%s'", args.Command)
     }
+    if cmd, ok := vaultCommands[args.Command]; ok {
+        return cmd(vaultSvc, args)
+    }
+    return fmt.Errorf("Unsupported command: '%s'", args.Command)
+}
+
+// newLimiter builds the request and bandwidth limits and, with --adaptive,
+// the adaptive cap on requests in flight. The cap starts at the most requests
+// the command's workers could have in flight.
+func newLimiter(args *Arguments) (*client.Limiter, error) {
+    bandwidth, err := parseSize(args.MaxBandwidth, 0)
+    if err != nil {
+        return nil, fmt.Errorf("invalid --max-bandwidth %v", err)
+    }
+    if args.MaxRequestRate < 0 || bandwidth < 0 {
+        return nil, fmt.Errorf("--max-rps and --max-bandwidth can not be negative")
+    }
+    maxConcurrency := 0
+    if args.Adaptive {
+        maxConcurrency = args.Concurrency
+        if args.Download && (args.Command == "restore_from_glacier" || args.Command == "resume") {
+            maxConcurrency *= args.PartConcurrency
+        }
+        if maxConcurrency < 1 {
+            maxConcurrency = 1
+        }
+    }
+    return client.NewLimiter(args.MaxRequestRate, float64(bandwidth), maxConcurrency, args.TargetLatency), nil
 }
 
 func ListCommands(args *Arguments) error {
@@ -33,5 +98,8 @@ func ListCommands(args *Arguments) error {
     for key, _ := range availableCommands {
         fmt.Printf("%s\n", key)
     }
+    for key, _ := range vaultCommands {
+        fmt.Printf("%s\n", key)
+    }
     return nil
 }
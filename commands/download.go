@@ -0,0 +1,329 @@
+package commands
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/SpectraLogic/glacier_recover/client"
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "io"
+    "os"
+    "path"
+    "strings"
+    "sync"
+)
+
+const defaultPartSizeMB = 64
+const defaultPartConcurrency = 4
+const defaultPartAttempts = 3
+
+// downloader fetches objects to local files as partSize byte ranges, several
+// at once, written into a pre-allocated part file. A failed range is retried
+// on its own.
+type downloader struct {
+    svc *s3.S3
+    bucket string
+    paths *outputPaths
+    partSize int64
+    partConcurrency int
+    partAttempts int
+    verify bool
+    report *reportWriter
+}
+
+func newDownloader(svc *s3.S3, args *Arguments) (*downloader, error) {
+    paths, err := newOutputPaths(args)
+    if err != nil {
+        return nil, err
+    }
+    if args.PartSizeMB < 1 {
+        return nil, fmt.Errorf("part-size must be at least 1 MB, got %d", args.PartSizeMB)
+    }
+    d := &downloader{
+        svc: svc,
+        bucket: args.Bucket,
+        paths: paths,
+        partSize: args.PartSizeMB * 1024 * 1024,
+        partConcurrency: args.PartConcurrency,
+        partAttempts: args.PartAttempts,
+        verify: args.Verify,
+    }
+    if d.partConcurrency < 1 {
+        d.partConcurrency = 1
+    }
+    if d.partAttempts < 1 {
+        d.partAttempts = 1
+    }
+    if d.verify && len(args.VerifyReport) > 0 {
+        d.report, err = newReportWriter(args.VerifyReport, args.Format, verifyReportHeader)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return d, nil
+}
+
+func (d *downloader) Close() error {
+    return d.report.Close()
+}
+
+// partialDownload is the sidecar kept next to a part file. It records the
+// byte ranges already written so a rerun only fetches what is missing.
+type partialDownload struct {
+    Key string
+    Size int64
+    ETag string
+    PartSize int64
+    Done [][2]int64
+}
+
+func loadPartialDownload(sidecar string) (*partialDownload, error) {
+    data, err := os.ReadFile(sidecar)
+    if err != nil {
+        return nil, err
+    }
+    partial := &partialDownload{}
+    if err = json.Unmarshal(data, partial); err != nil {
+        return nil, err
+    }
+    return partial, nil
+}
+
+// save writes the sidecar through a temporary file so a crash never leaves a
+// truncated record behind.
+func (partial *partialDownload) save(sidecar string) error {
+    data, err := json.Marshal(partial)
+    if err != nil {
+        return err
+    }
+    if err = os.WriteFile(sidecar + ".tmp", data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(sidecar + ".tmp", sidecar)
+}
+
+func (partial *partialDownload) matches(key string, size int64, etag string, partSize int64) bool {
+    return partial.Key == key && partial.Size == size && partial.ETag == etag && partial.PartSize == partSize
+}
+
+// Download writes key to a part file with a sidecar of completed ranges, then
+// renames it into place once every range is written and its length, and with
+// verify its content, checks out. A failed download keeps both files so the
+// next run continues from them, unless verification showed the data is bad.
+// Noncurrent versions are saved with the version id before the extension.
+func (d *downloader) Download(object *objectEntry) error {
+    key := object.Key
+    name := versionName(key, object.VersionId)
+    // directory markers have nothing to download
+    if strings.HasSuffix(key, "/") {
+        return nil
+    }
+    size, etag := object.Size, object.ETag
+    var head *s3.HeadObjectOutput
+    if len(etag) == 0 || d.verify {
+        var err error
+        head, err = d.svc.HeadObject(
+            &s3.HeadObjectInput{
+                Bucket: aws.String(d.bucket),
+                Key:  aws.String(key),
+                VersionId: optionalString(object.VersionId),
+                ChecksumMode: aws.String(s3.ChecksumModeEnabled)})
+        if err != nil {
+            return fmt.Errorf("Head object failed: %v\n", err)
+        }
+        size, etag = aws.Int64Value(head.ContentLength), aws.StringValue(head.ETag)
+    }
+
+    localKey := key
+    if object.Noncurrent {
+        ext := path.Ext(key)
+        localKey = strings.TrimSuffix(key, ext) + "." + object.VersionId + ext
+    }
+    target, skip, err := d.paths.prepare(localKey)
+    if err != nil {
+        return err
+    }
+    if skip {
+        fmt.Fprintf(statusOut, "Skipped, file exists: %s\n", target)
+        return nil
+    }
+
+    part := d.paths.partPath(target, name)
+    sidecar := part + ".json"
+    partial, err := loadPartialDownload(sidecar)
+    resuming := err == nil && partial.matches(name, size, etag, d.partSize)
+    if resuming {
+        if info, err := os.Stat(part); err != nil || info.Size() != size {
+            resuming = false
+        }
+    }
+    var file *os.File
+    if resuming {
+        fmt.Fprintf(statusOut, "Resuming: %s %d of %d parts done\n", name, len(partial.Done), partCount(size, d.partSize))
+        file, err = os.OpenFile(part, os.O_WRONLY, 0644)
+    } else {
+        partial = &partialDownload{Key: name, Size: size, ETag: etag, PartSize: d.partSize}
+        file, err = os.Create(part)
+        if err == nil {
+            err = file.Truncate(size)
+        }
+        if err == nil {
+            err = partial.save(sidecar)
+        }
+    }
+    if err != nil {
+        if file != nil {
+            file.Close()
+        }
+        return fmt.Errorf("failed to prepare %s, %v\n", part, err)
+    }
+
+    err = d.getParts(object, file, partial, sidecar)
+    if err == nil {
+        err = file.Sync()
+    }
+    closeErr := file.Close()
+    if err != nil {
+        return err
+    }
+    if closeErr != nil {
+        return closeErr
+    }
+
+    if info, err := os.Stat(part); err != nil || info.Size() != size {
+        return fmt.Errorf("download of %s is incomplete", name)
+    }
+    if len(partial.Done) != partCount(size, d.partSize) {
+        return fmt.Errorf("download of %s is missing parts", name)
+    }
+    if d.verify {
+        result, err := verifyDownload(d.svc, d.bucket, key, object.VersionId, part, head)
+        if err != nil {
+            // the download is kept, a later run verifies it again
+            return fmt.Errorf("could not verify %s, %v", name, err)
+        }
+        result.File = target
+        result.Retries = client.TakeRetries(d.svc, key, object.VersionId)
+        if err = d.report.Write(result.row()...); err != nil {
+            return err
+        }
+        if result.Result == verifyMismatch {
+            // the data is bad, so the next run must start over
+            os.Remove(part)
+            os.Remove(sidecar)
+            return fmt.Errorf("verification failed for %s: %s", name, result.Detail)
+        }
+    }
+    fileName, err := d.paths.place(part, target)
+    if err != nil {
+        return err
+    }
+    os.Remove(sidecar)
+    fmt.Fprintf(statusOut, "Restored: %s\n", fileName)
+    return nil
+}
+
+func partCount(size int64, partSize int64) int {
+    return int((size + partSize - 1) / partSize)
+}
+
+// getParts fetches every range partial does not record as done, partConcurrency
+// at a time, recording each in the sidecar as it completes.
+func (d *downloader) getParts(object *objectEntry, file *os.File, partial *partialDownload, sidecar string) error {
+    done := map[int64]bool{}
+    for _, r := range partial.Done {
+        done[r[0]] = true
+    }
+
+    starts := make(chan int64)
+    var lock sync.Mutex
+    var failed error
+    var wg sync.WaitGroup
+    for i := 0; i < d.partConcurrency; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for start := range starts {
+                end := start + d.partSize - 1
+                if end >= partial.Size {
+                    end = partial.Size - 1
+                }
+                err := d.getPart(object.Key, object.VersionId, partial.ETag, file, start, end)
+                // the sidecar may only list a range once its data is on disk
+                if err == nil {
+                    err = file.Sync()
+                }
+                lock.Lock()
+                if err == nil {
+                    partial.Done = append(partial.Done, [2]int64{start, end})
+                    err = partial.save(sidecar)
+                }
+                if err != nil && failed == nil {
+                    failed = err
+                }
+                lock.Unlock()
+            }
+        }()
+    }
+    for start := int64(0); start < partial.Size; start += d.partSize {
+        if done[start] {
+            continue
+        }
+        lock.Lock()
+        stop := failed != nil
+        lock.Unlock()
+        if stop {
+            break
+        }
+        starts <- start
+    }
+    close(starts)
+    wg.Wait()
+    return failed
+}
+
+// getPart writes bytes start-end of key, or that version of it, at the same
+// offset in file, retrying the range up to partAttempts times. The ranged GET
+// is conditional on etag so parts of a replaced object are never mixed.
+func (d *downloader) getPart(key string, versionId string, etag string, file *os.File, start int64, end int64) error {
+    var err error
+    for attempt := 1; attempt <= d.partAttempts; attempt++ {
+        input := &s3.GetObjectInput{
+            Bucket: aws.String(d.bucket),
+            Key:  aws.String(key),
+            VersionId: optionalString(versionId),
+            Range: aws.String(fmt.Sprintf("bytes=%d-%d", start, end))}
+        if len(etag) > 0 {
+            input.IfMatch = aws.String(etag)
+        }
+        var result *s3.GetObjectOutput
+        result, err = d.svc.GetObject(input)
+        if err != nil {
+            err = fmt.Errorf("falied to retrieve %s bytes %d-%d, %v\n", key, start, end, err)
+            continue
+        }
+        var written int64
+        written, err = io.Copy(&offsetWriter{file, start}, result.Body)
+        result.Body.Close()
+        if err == nil && written != end - start + 1 {
+            err = fmt.Errorf("short read for %s bytes %d-%d: got %d bytes", key, start, end, written)
+        }
+        if err == nil {
+            return nil
+        }
+        err = fmt.Errorf("falied to write %s bytes %d-%d, %v\n", key, start, end, err)
+    }
+    return err
+}
+
+// offsetWriter writes sequentially into a file starting at offset.
+type offsetWriter struct {
+    file *os.File
+    offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+    n, err := w.file.WriteAt(p, w.offset)
+    w.offset += int64(n)
+    return n, err
+}
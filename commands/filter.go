@@ -0,0 +1,310 @@
+package commands
+
+import (
+    "fmt"
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "os"
+    "path"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// objectFilter limits commands to objects matching all of its conditions.
+// A zero value matches everything.
+type objectFilter struct {
+    storageClasses map[string]bool
+    minSize int64
+    maxSize int64
+    modifiedAfter time.Time
+    modifiedBefore time.Time
+    include []string
+    exclude []string
+    includeRegex *regexp.Regexp
+    excludeRegex *regexp.Regexp
+}
+
+func newObjectFilter(args *Arguments) (*objectFilter, error) {
+    filter := &objectFilter{maxSize: -1}
+    var err error
+    if len(args.StorageClass) > 0 {
+        filter.storageClasses = map[string]bool{}
+        for _, class := range strings.Split(args.StorageClass, ",") {
+            filter.storageClasses[strings.ToUpper(strings.TrimSpace(class))] = true
+        }
+    }
+    if filter.minSize, err = parseSize(args.MinSize, 0); err != nil {
+        return nil, err
+    }
+    if filter.maxSize, err = parseSize(args.MaxSize, -1); err != nil {
+        return nil, err
+    }
+    if filter.modifiedAfter, err = parseDate(args.ModifiedAfter); err != nil {
+        return nil, err
+    }
+    if filter.modifiedBefore, err = parseDate(args.ModifiedBefore); err != nil {
+        return nil, err
+    }
+    filter.include = splitPatterns(args.Include)
+    filter.exclude = splitPatterns(args.Exclude)
+    for _, pattern := range append(append([]string{}, filter.include...), filter.exclude...) {
+        if _, err = path.Match(pattern, ""); err != nil {
+            return nil, fmt.Errorf("invalid pattern '%s' %v", pattern, err)
+        }
+    }
+    if len(args.IncludeRegex) > 0 {
+        if filter.includeRegex, err = regexp.Compile(args.IncludeRegex); err != nil {
+            return nil, fmt.Errorf("invalid include-regex %v", err)
+        }
+    }
+    if len(args.ExcludeRegex) > 0 {
+        if filter.excludeRegex, err = regexp.Compile(args.ExcludeRegex); err != nil {
+            return nil, fmt.Errorf("invalid exclude-regex %v", err)
+        }
+    }
+    return filter, nil
+}
+
+// parseSize reads a byte count with an optional KB, MB, GB or TB suffix
+// (powers of 1024).
+func parseSize(size string, empty int64) (int64, error) {
+    size = strings.ToUpper(strings.TrimSpace(size))
+    if len(size) == 0 {
+        return empty, nil
+    }
+    multiplier := int64(1)
+    for i, suffix := range []string{"KB", "MB", "GB", "TB"} {
+        if strings.HasSuffix(size, suffix) {
+            multiplier = int64(1) << (10 * uint(i + 1))
+            size = strings.TrimSpace(strings.TrimSuffix(size, suffix))
+            break
+        }
+    }
+    size = strings.TrimSuffix(size, "B")
+    value, err := strconv.ParseFloat(size, 64)
+    if err != nil || value < 0 {
+        return 0, fmt.Errorf("invalid size '%s'", size)
+    }
+    return int64(value * float64(multiplier)), nil
+}
+
+// parseDate reads a 2006-01-02 date or an RFC3339 time.
+func parseDate(date string) (time.Time, error) {
+    if len(date) == 0 {
+        return time.Time{}, nil
+    }
+    if t, err := time.Parse("2006-01-02", date); err == nil {
+        return t, nil
+    }
+    t, err := time.Parse(time.RFC3339, date)
+    if err != nil {
+        return time.Time{}, fmt.Errorf("invalid date '%s', use 2006-01-02 or RFC3339", date)
+    }
+    return t, nil
+}
+
+func splitPatterns(patterns string) []string {
+    result := []string{}
+    for _, pattern := range strings.Split(patterns, ",") {
+        if pattern = strings.TrimSpace(pattern); len(pattern) > 0 {
+            result = append(result, pattern)
+        }
+    }
+    return result
+}
+
+// active reports whether the filter has any condition at all.
+func (filter *objectFilter) active() bool {
+    return filter.needsMetadata() || len(filter.include) > 0 || len(filter.exclude) > 0 ||
+        filter.includeRegex != nil || filter.excludeRegex != nil
+}
+
+// needsMetadata reports whether matching needs more than the key.
+func (filter *objectFilter) needsMetadata() bool {
+    return filter.storageClasses != nil || filter.minSize > 0 || filter.maxSize >= 0 ||
+        !filter.modifiedAfter.IsZero() || !filter.modifiedBefore.IsZero()
+}
+
+// globMatch matches patterns containing a / against the whole key and others
+// against the last element, so *.mov finds .mov files at any depth.
+func globMatch(pattern string, key string) bool {
+    name := key
+    if !strings.Contains(pattern, "/") {
+        name = path.Base(key)
+    }
+    matched, _ := path.Match(pattern, name)
+    return matched
+}
+
+func (filter *objectFilter) matches(object *objectEntry) bool {
+    return filter.matchesKey(object.Key) && filter.matchesMetadata(object)
+}
+
+// matchesMetadata checks the conditions on storage class, size and date.
+func (filter *objectFilter) matchesMetadata(object *objectEntry) bool {
+    if filter.storageClasses != nil && !filter.storageClasses[object.StorageClass] {
+        return false
+    }
+    if object.Size < filter.minSize || (filter.maxSize >= 0 && object.Size > filter.maxSize) {
+        return false
+    }
+    if !filter.modifiedAfter.IsZero() && !object.LastModified.After(filter.modifiedAfter) {
+        return false
+    }
+    if !filter.modifiedBefore.IsZero() && !object.LastModified.Before(filter.modifiedBefore) {
+        return false
+    }
+    return true
+}
+
+// matchesKey checks the include and exclude patterns and regular expressions.
+func (filter *objectFilter) matchesKey(key string) bool {
+    if len(filter.include) > 0 {
+        included := false
+        for _, pattern := range filter.include {
+            included = included || globMatch(pattern, key)
+        }
+        if !included {
+            return false
+        }
+    }
+    for _, pattern := range filter.exclude {
+        if globMatch(pattern, key) {
+            return false
+        }
+    }
+    if filter.includeRegex != nil && !filter.includeRegex.MatchString(key) {
+        return false
+    }
+    if filter.excludeRegex != nil && filter.excludeRegex.MatchString(key) {
+        return false
+    }
+    return true
+}
+
+// filterObjects keeps the listed objects that match.
+func (filter *objectFilter) filterObjects(objects []*s3.Object) []*s3.Object {
+    kept := objects[:0]
+    for _, object := range objects {
+        if filter.matches(objectEntryFromListing(object)) {
+            kept = append(kept, object)
+        }
+    }
+    return kept
+}
+
+// filteredKeySource passes on the objects from source that match filter.
+// Objects from sources without listing metadata, such as manifests or a
+// single key, are looked up with HEAD when the filter needs it. The HEADs run
+// concurrency at a time on a worker pool, and objects are still passed on in
+// the order source gives them.
+type filteredKeySource struct {
+    source keySource
+    filter *objectFilter
+    svc *s3.S3
+    bucket string
+    concurrency int
+}
+
+func (src *filteredKeySource) Walk(visit func(*objectEntry) error) error {
+    if !src.filter.needsMetadata() {
+        return src.source.Walk(func(object *objectEntry) error {
+            if !src.filter.matches(object) {
+                return nil
+            }
+            return visit(object)
+        })
+    }
+
+    var mu sync.Mutex
+    var visitErr error
+    listed := map[*objectEntry]int{}
+    finished := map[int]*objectEntry{}
+    count, next := 0, 0
+    sequenced := &sequencedKeySource{source: src.source, visit: func(object *objectEntry) error {
+        mu.Lock()
+        defer mu.Unlock()
+        listed[object] = count
+        count++
+        // stop reading the source once the caller has failed
+        return visitErr
+    }}
+    _, err := newWorkerPool(src.concurrency).Run(sequenced, func(object *objectEntry) error {
+        keep := src.lookup(object)
+        mu.Lock()
+        defer mu.Unlock()
+        seq := listed[object]
+        delete(listed, object)
+        finished[seq] = nil
+        if keep {
+            finished[seq] = object
+        }
+        // hand on every object whose turn has come, in source order
+        for {
+            ready, ok := finished[next]
+            if !ok {
+                return nil
+            }
+            delete(finished, next)
+            next++
+            if ready != nil && visitErr == nil {
+                visitErr = visit(ready)
+            }
+        }
+    })
+    if visitErr != nil {
+        return visitErr
+    }
+    return err
+}
+
+// lookup fills in the metadata of object if it has none and says whether it
+// matches. The key is matched first, so objects it excludes are never looked
+// up. An object HEAD fails on is passed on with LookupErr set, so the command
+// reports it failed rather than the whole run stopping.
+func (src *filteredKeySource) lookup(object *objectEntry) bool {
+    if !src.filter.matchesKey(object.Key) {
+        return false
+    }
+    if !object.LastModified.IsZero() {
+        return src.filter.matchesMetadata(object)
+    }
+    head, err := src.svc.HeadObject(
+        &s3.HeadObjectInput{
+            Bucket: aws.String(src.bucket),
+            Key:  aws.String(object.Key),
+            VersionId: optionalString(object.VersionId)})
+    if err != nil {
+        object.LookupErr = fmt.Errorf("could not get metadata to filter on, %s", strings.Join(strings.Fields(err.Error()), " "))
+        fmt.Fprintf(os.Stderr, "Failed: %s %v\n", versionName(object.Key, object.VersionId), object.LookupErr)
+        return true
+    }
+    object.Size = aws.Int64Value(head.ContentLength)
+    object.LastModified = aws.TimeValue(head.LastModified)
+    object.ETag = aws.StringValue(head.ETag)
+    object.StorageClass = aws.StringValue(head.StorageClass)
+    // HEAD omits the storage class for STANDARD objects
+    if len(object.StorageClass) == 0 {
+        object.StorageClass = s3.StorageClassStandard
+    }
+    return src.filter.matchesMetadata(object)
+}
+
+// sequencedKeySource calls visit on each object of source before passing it
+// on, so its place in the order can be noted; an error stops the walk.
+type sequencedKeySource struct {
+    source keySource
+    visit func(*objectEntry) error
+}
+
+func (src *sequencedKeySource) Walk(visit func(*objectEntry) error) error {
+    return src.source.Walk(func(object *objectEntry) error {
+        if err := src.visit(object); err != nil {
+            return err
+        }
+        return visit(object)
+    })
+}
@@ -0,0 +1,216 @@
+package commands
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "os"
+    "sync"
+    "time"
+)
+
+// jobState is how far a key has progressed through a restore_from_glacier job.
+type jobState string
+
+const (
+    stateNone jobState = ""
+    stateRequested jobState = "requested"
+    stateReady jobState = "ready"
+    stateDownloaded jobState = "downloaded"
+    stateFailed jobState = "failed"
+)
+
+var stateOrder = map[jobState]int {
+    stateNone: 0,
+    stateRequested: 1,
+    stateReady: 2,
+    stateDownloaded: 3,
+}
+
+// jobHeader is the first line of a job file and holds what resume needs to run
+// the job again.
+type jobHeader struct {
+    Bucket string
+    Key string `json:",omitempty"`
+    Prefix string `json:",omitempty"`
+    Manifest string `json:",omitempty"`
+    ManifestFormat string `json:",omitempty"`
+    ManifestColumn string `json:",omitempty"`
+    ManifestVersionColumn string `json:",omitempty"`
+    InventoryReport string `json:",omitempty"`
+    StorageClass string `json:",omitempty"`
+    MinSize string `json:",omitempty"`
+    MaxSize string `json:",omitempty"`
+    ModifiedAfter string `json:",omitempty"`
+    ModifiedBefore string `json:",omitempty"`
+    Include string `json:",omitempty"`
+    Exclude string `json:",omitempty"`
+    IncludeRegex string `json:",omitempty"`
+    ExcludeRegex string `json:",omitempty"`
+    Tier string
+    Days int64
+    Download bool
+    Started time.Time
+}
+
+// jobRecord is one state transition for a key. Failed records keep the error
+// and leave the key at its last good state so resume retries that step. A key
+// whose restored copy expired is moved back to stateNone with the reason.
+type jobRecord struct {
+    Key string
+    State jobState
+    Time time.Time
+    Error string `json:",omitempty"`
+}
+
+// jobJournal is an append-only file of JSON lines: a jobHeader followed by one
+// jobRecord per transition. Each record is synced so the journal survives a
+// crash or reboot.
+type jobJournal struct {
+    mu sync.Mutex
+    file *os.File
+    Header jobHeader
+    states map[string]jobState
+}
+
+func createJobJournal(jobFile string, header jobHeader) (*jobJournal, error) {
+    file, err := os.OpenFile(jobFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+    if err != nil {
+        if os.IsExist(err) {
+            return nil, fmt.Errorf("job file %s already exists, use the resume command to continue it", jobFile)
+        }
+        return nil, fmt.Errorf("Could not create %s\n%v\n", jobFile, err)
+    }
+    journal := &jobJournal{file: file, Header: header, states: map[string]jobState{}}
+    if err = journal.append(header); err != nil {
+        file.Close()
+        return nil, err
+    }
+    return journal, nil
+}
+
+func openJobJournal(jobFile string) (*jobJournal, error) {
+    file, err := os.OpenFile(jobFile, os.O_RDWR|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, fmt.Errorf("Could not open %s\n%v\n", jobFile, err)
+    }
+    journal := &jobJournal{file: file, states: map[string]jobState{}}
+
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+    if !scanner.Scan() {
+        file.Close()
+        return nil, fmt.Errorf("job file %s has no header", jobFile)
+    }
+    if err = json.Unmarshal(scanner.Bytes(), &journal.Header); err != nil {
+        file.Close()
+        return nil, fmt.Errorf("job file %s has an invalid header %v", jobFile, err)
+    }
+    for scanner.Scan() {
+        var record jobRecord
+        // a crash mid-write can leave a partial last line; skip it
+        if json.Unmarshal(scanner.Bytes(), &record) != nil {
+            continue
+        }
+        if record.State != stateFailed {
+            journal.states[record.Key] = record.State
+        }
+    }
+    if err = scanner.Err(); err != nil {
+        file.Close()
+        return nil, fmt.Errorf("failed reading job file %s %v", jobFile, err)
+    }
+    // terminate a partial last line so new records start on their own line
+    if info, err := file.Stat(); err == nil && info.Size() > 0 {
+        last := make([]byte, 1)
+        if _, err = file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+            file.Write([]byte{'\n'})
+        }
+    }
+    return journal, nil
+}
+
+func (journal *jobJournal) append(v interface{}) error {
+    line, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    if _, err = journal.file.Write(append(line, '\n')); err != nil {
+        return fmt.Errorf("failed writing job file %v", err)
+    }
+    return journal.file.Sync()
+}
+
+// Record appends a transition for key. A nil journal records nothing so
+// callers need not check whether a job file is in use.
+func (journal *jobJournal) Record(key string, state jobState, stepErr error) error {
+    if journal == nil {
+        return nil
+    }
+    record := jobRecord{Key: key, State: state, Time: time.Now()}
+    if stepErr != nil {
+        record.State = stateFailed
+        record.Error = stepErr.Error()
+    }
+    journal.mu.Lock()
+    defer journal.mu.Unlock()
+    if record.State != stateFailed {
+        journal.states[key] = record.State
+    }
+    return journal.append(record)
+}
+
+// Reset moves key back to stateNone, noting why, so resume requests its
+// restore again.
+func (journal *jobJournal) Reset(key string, reason error) error {
+    if journal == nil {
+        return nil
+    }
+    record := jobRecord{Key: key, State: stateNone, Time: time.Now(), Error: reason.Error()}
+    journal.mu.Lock()
+    defer journal.mu.Unlock()
+    journal.states[key] = stateNone
+    return journal.append(record)
+}
+
+func (journal *jobJournal) State(key string) jobState {
+    if journal == nil {
+        return stateNone
+    }
+    journal.mu.Lock()
+    defer journal.mu.Unlock()
+    return journal.states[key]
+}
+
+func (journal *jobJournal) Close() error {
+    if journal == nil {
+        return nil
+    }
+    return journal.file.Close()
+}
+
+// Pending filters source down to the keys the journal has at least at state
+// from but not yet at state to. Without a journal every key is pending.
+func (journal *jobJournal) Pending(source keySource, from jobState, to jobState) keySource {
+    if journal == nil {
+        return source
+    }
+    return &journalKeySource{source, journal, from, to}
+}
+
+type journalKeySource struct {
+    source keySource
+    journal *jobJournal
+    from jobState
+    to jobState
+}
+
+func (src *journalKeySource) Walk(visit func(*objectEntry) error) error {
+    return src.source.Walk(func(object *objectEntry) error {
+        at := stateOrder[src.journal.State(object.Key)]
+        if at < stateOrder[src.from] || at >= stateOrder[src.to] {
+            return nil
+        }
+        return visit(object)
+    })
+}
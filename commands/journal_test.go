@@ -0,0 +1,105 @@
+package commands
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func TestOpenJobJournalReplay(t *testing.T) {
+    dir := t.TempDir()
+    tests := []struct {
+        name string
+        records string
+        want map[string]jobState
+    }{
+        {"header only", "", map[string]jobState{"a": stateNone}},
+        {"progress", `{"Key":"a","State":"requested"}
+{"Key":"b","State":"requested"}
+{"Key":"a","State":"ready"}
+{"Key":"a","State":"downloaded"}
+`, map[string]jobState{"a": stateDownloaded, "b": stateRequested}},
+        {"failure keeps the last good state", `{"Key":"a","State":"requested"}
+{"Key":"a","State":"failed","Error":"AccessDenied"}
+{"Key":"b","State":"failed","Error":"AccessDenied"}
+`, map[string]jobState{"a": stateRequested, "b": stateNone}},
+        {"expired copy goes back to none", `{"Key":"a","State":"requested"}
+{"Key":"a","State":"ready"}
+{"Key":"a","State":"","Error":"no restored copy to download"}
+`, map[string]jobState{"a": stateNone}},
+        {"truncated last line", `{"Key":"a","State":"requested"}
+{"Key":"a","State":"re`, map[string]jobState{"a": stateRequested}},
+        {"truncated line inside", `{"Key":"a","State":"requested"}
+{"Key":"a","St
+{"Key":"b","State":"ready"}
+`, map[string]jobState{"a": stateRequested, "b": stateReady}},
+    }
+    for i, test := range tests {
+        jobFile := filepath.Join(dir, "job" + strconv.Itoa(i) + ".json")
+        journal, err := createJobJournal(jobFile, jobHeader{Bucket: "bucket", Tier: "Bulk", Days: 3})
+        if err != nil {
+            t.Fatal(err)
+        }
+        journal.file.WriteString(test.records)
+        journal.Close()
+
+        journal, err = openJobJournal(jobFile)
+        if err != nil {
+            t.Errorf("%s: openJobJournal error %v", test.name, err)
+            continue
+        }
+        if journal.Header.Bucket != "bucket" || journal.Header.Tier != "Bulk" || journal.Header.Days != 3 {
+            t.Errorf("%s: header = %+v", test.name, journal.Header)
+        }
+        for key, want := range test.want {
+            if got := journal.State(key); got != want {
+                t.Errorf("%s: State(%s) = %q, want %q", test.name, key, got, want)
+            }
+        }
+
+        // records written after a resume must replay too
+        journal.Record("c", stateReady, nil)
+        journal.Reset("d", errors.New("expired"))
+        journal.Close()
+        journal, err = openJobJournal(jobFile)
+        if err != nil {
+            t.Errorf("%s: reopen error %v", test.name, err)
+            continue
+        }
+        if got := journal.State("c"); got != stateReady {
+            t.Errorf("%s: after reopen State(c) = %q, want %q", test.name, got, stateReady)
+        }
+        for key, want := range test.want {
+            if got := journal.State(key); got != want {
+                t.Errorf("%s: after reopen State(%s) = %q, want %q", test.name, key, got, want)
+            }
+        }
+        journal.Close()
+    }
+}
+
+func TestOpenJobJournalErrors(t *testing.T) {
+    dir := t.TempDir()
+    tests := []struct {
+        name string
+        content string
+        wantErr string
+    }{
+        {"empty", "", "has no header"},
+        {"bad header", "{\"Bucket\":\n", "invalid header"},
+    }
+    for i, test := range tests {
+        jobFile := filepath.Join(dir, "job" + strconv.Itoa(i) + ".json")
+        os.WriteFile(jobFile, []byte(test.content), 0644)
+        _, err := openJobJournal(jobFile)
+        if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+            t.Errorf("%s: openJobJournal error %v, want one containing %q", test.name, err, test.wantErr)
+        }
+    }
+    if _, err := openJobJournal(filepath.Join(dir, "missing.json")); err == nil {
+        t.Errorf("missing: openJobJournal gave no error")
+    }
+}
@@ -0,0 +1,206 @@
+package commands
+
+import (
+    "fmt"
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "time"
+)
+
+// objectEntry is one object to act on, with whatever metadata the source listed.
+type objectEntry struct {
+    Key string
+    VersionId string
+    Size int64
+    StorageClass string
+    LastModified time.Time
+    ETag string
+    // Noncurrent is set for versions listed with --versions that are not the
+    // latest version of their key.
+    Noncurrent bool
+    // LookupErr is set when a source could not find out what it needs to
+    // about the object, such as the metadata a filter needs or whether it
+    // has a restored copy to download. Such objects are reported failed and
+    // never acted on.
+    LookupErr error
+}
+
+// versionName is key with its version id, if any, for messages and to tell
+// versions of a key apart.
+func versionName(key string, versionId string) string {
+    if len(versionId) == 0 {
+        return key
+    }
+    return key + "?versionId=" + versionId
+}
+
+// optionalString leaves an empty request field unset.
+func optionalString(value string) *string {
+    if len(value) == 0 {
+        return nil
+    }
+    return aws.String(value)
+}
+
+// keySource streams objects to visit one at a time; walking stops at the first
+// error visit returns.
+type keySource interface {
+    Walk(visit func(*objectEntry) error) error
+}
+
+// prefixKeySource lists every object under a prefix, following continuation
+// tokens until the listing is exhausted.
+type prefixKeySource struct {
+    svc *s3.S3
+    bucket string
+    prefix string
+}
+
+func newPrefixKeySource(svc *s3.S3, bucket string, prefix string) *prefixKeySource {
+    return &prefixKeySource{svc: svc, bucket: bucket, prefix: prefix}
+}
+
+func (src *prefixKeySource) Walk(visit func(*objectEntry) error) error {
+    var visitErr error
+    count := 0
+    err := src.svc.ListObjectsV2Pages(
+        &s3.ListObjectsV2Input{
+            Bucket: aws.String(src.bucket),
+            Prefix: aws.String(src.prefix),
+            MaxKeys: aws.Int64(1000)},
+        func(resp *s3.ListObjectsV2Output, more bool) bool {
+            for _, object := range resp.Contents {
+                count++
+                visitErr = visit(objectEntryFromListing(object))
+                if visitErr != nil {
+                    return false
+                }
+            }
+            return true
+        })
+    if err != nil {
+        return fmt.Errorf("failed getting object list %v\n", err)
+    }
+    if visitErr != nil {
+        return visitErr
+    }
+    if count == 0 {
+        return fmt.Errorf("no objects match bucket %s and prefix %s\n", src.bucket, src.prefix)
+    }
+    return nil
+}
+
+func objectEntryFromListing(object *s3.Object) *objectEntry {
+    return &objectEntry{
+        Key: aws.StringValue(object.Key),
+        Size: aws.Int64Value(object.Size),
+        StorageClass: aws.StringValue(object.StorageClass),
+        LastModified: aws.TimeValue(object.LastModified),
+        ETag: aws.StringValue(object.ETag),
+    }
+}
+
+// versionKeySource lists every version under a prefix with
+// ListObjectVersions, following continuation markers. Delete markers have no
+// data to restore or download and are not visited.
+type versionKeySource struct {
+    svc *s3.S3
+    bucket string
+    prefix string
+}
+
+func newVersionKeySource(svc *s3.S3, bucket string, prefix string) *versionKeySource {
+    return &versionKeySource{svc: svc, bucket: bucket, prefix: prefix}
+}
+
+func (src *versionKeySource) Walk(visit func(*objectEntry) error) error {
+    var visitErr error
+    count := 0
+    err := src.svc.ListObjectVersionsPages(
+        &s3.ListObjectVersionsInput{
+            Bucket: aws.String(src.bucket),
+            Prefix: aws.String(src.prefix),
+            MaxKeys: aws.Int64(1000)},
+        func(resp *s3.ListObjectVersionsOutput, more bool) bool {
+            for _, version := range resp.Versions {
+                count++
+                visitErr = visit(objectEntryFromVersion(version))
+                if visitErr != nil {
+                    return false
+                }
+            }
+            return true
+        })
+    if err != nil {
+        return fmt.Errorf("failed getting object version list %v\n", err)
+    }
+    if visitErr != nil {
+        return visitErr
+    }
+    if count == 0 {
+        return fmt.Errorf("no object versions match bucket %s and prefix %s\n", src.bucket, src.prefix)
+    }
+    return nil
+}
+
+func objectEntryFromVersion(version *s3.ObjectVersion) *objectEntry {
+    return &objectEntry{
+        Key: aws.StringValue(version.Key),
+        VersionId: aws.StringValue(version.VersionId),
+        Size: aws.Int64Value(version.Size),
+        StorageClass: aws.StringValue(version.StorageClass),
+        LastModified: aws.TimeValue(version.LastModified),
+        ETag: aws.StringValue(version.ETag),
+        Noncurrent: !aws.BoolValue(version.IsLatest),
+    }
+}
+
+// singleKeySource yields one key, or one version of it, with no listing
+// metadata.
+type singleKeySource struct {
+    key string
+    versionId string
+}
+
+func (src *singleKeySource) Walk(visit func(*objectEntry) error) error {
+    return visit(&objectEntry{Key: src.key, VersionId: src.versionId})
+}
+
+// keySourceFromArgs picks the source of keys for bulk commands: a --manifest,
+// a single --key (and --version-id), everything under --prefix in an
+// --inventory-report, or everything under --prefix, every version of it with
+// --versions; then applies the object filter options.
+func keySourceFromArgs(svc *s3.S3, args *Arguments) (keySource, error) {
+    source, err := unfilteredKeySource(svc, args)
+    if err != nil {
+        return nil, err
+    }
+    filter, err := newObjectFilter(args)
+    if err != nil {
+        return nil, err
+    }
+    if !filter.active() {
+        return source, nil
+    }
+    return &filteredKeySource{source: source, filter: filter, svc: svc, bucket: args.Bucket,
+        concurrency: args.Concurrency}, nil
+}
+
+func unfilteredKeySource(svc *s3.S3, args *Arguments) (keySource, error) {
+    if len(args.Manifest) > 0 {
+        return newManifestKeySource(args)
+    }
+    if len(args.InventoryReport) > 0 {
+        return newInventoryReportSource(svc, args), nil
+    }
+    if len(args.Key) > 0 {
+        return &singleKeySource{key: args.Key, versionId: args.VersionId}, nil
+    }
+    if len(args.Prefix) > 0 && args.Versions {
+        return newVersionKeySource(svc, args.Bucket, args.Prefix), nil
+    }
+    if len(args.Prefix) > 0 {
+        return newPrefixKeySource(svc, args.Bucket, args.Prefix), nil
+    }
+    return nil, fmt.Errorf("Must specify either key, prefix or manifest")
+}
@@ -0,0 +1,193 @@
+package commands
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/csv"
+    "fmt"
+    "io"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+const (
+    manifestAuto = "auto"
+    manifestCsv = "csv"
+    manifestText = "text"
+    manifestS3Inventory = "s3-inventory"
+)
+
+// manifestKeySource reads keys, and optionally version ids, from a file or
+// stdin ("-"):
+//   text          one key per line
+//   csv           a key column chosen by header name or 1-based index; a
+//                 header row is expected when the column is named, or when
+//                 the first row has a "Key" column (inventory and
+//                 test_byte_restore output)
+//   s3-inventory  S3 Inventory CSV: no header, bucket then URL-encoded key
+type manifestKeySource struct {
+    fileName string
+    format string
+    keyColumn string
+    versionColumn string
+    // stdin holds what was read of stdin, which can only be read once, so
+    // restore_from_glacier can walk the manifest again to wait and download
+    stdin []byte
+}
+
+func newManifestKeySource(args *Arguments) (*manifestKeySource, error) {
+    format := args.ManifestFormat
+    if format == manifestAuto || len(format) == 0 {
+        format = manifestText
+        if strings.EqualFold(filepath.Ext(args.Manifest), ".csv") {
+            format = manifestCsv
+        }
+    }
+    switch format {
+    case manifestCsv, manifestText, manifestS3Inventory:
+    default:
+        return nil, fmt.Errorf("invalid manifest-format '%s', must be one of %s, %s, %s, %s",
+            args.ManifestFormat, manifestAuto, manifestCsv, manifestText, manifestS3Inventory)
+    }
+    return &manifestKeySource{
+        fileName: args.Manifest,
+        format: format,
+        keyColumn: args.ManifestColumn,
+        versionColumn: args.ManifestVersionColumn,
+    }, nil
+}
+
+func (src *manifestKeySource) Walk(visit func(*objectEntry) error) error {
+    var r io.Reader = io.MultiReader(bytes.NewReader(src.stdin), io.TeeReader(os.Stdin, &appendWriter{&src.stdin}))
+    if src.fileName != "-" {
+        f, err := os.Open(src.fileName)
+        if err != nil {
+            return fmt.Errorf("Could not open %s\n%v\n", src.fileName, err)
+        }
+        defer f.Close()
+        r = f
+    }
+    if src.format == manifestText {
+        return src.walkText(bufio.NewReader(r), visit)
+    }
+    return src.walkCsv(bufio.NewReader(r), visit)
+}
+
+// appendWriter appends what is written to a byte slice.
+type appendWriter struct {
+    buf *[]byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+    *w.buf = append(*w.buf, p...)
+    return len(p), nil
+}
+
+func (src *manifestKeySource) walkText(r io.Reader, visit func(*objectEntry) error) error {
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+    for scanner.Scan() {
+        key := strings.TrimRight(scanner.Text(), "\r")
+        if len(strings.TrimSpace(key)) == 0 {
+            continue
+        }
+        if err := visit(&objectEntry{Key: key}); err != nil {
+            return err
+        }
+    }
+    return scanner.Err()
+}
+
+func (src *manifestKeySource) walkCsv(r io.Reader, visit func(*objectEntry) error) error {
+    reader := csv.NewReader(r)
+    reader.FieldsPerRecord = -1
+
+    keyIndex, versionIndex := -1, -1
+    if src.format == manifestS3Inventory {
+        keyIndex = 1
+    }
+    first := true
+    for {
+        record, err := reader.Read()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return fmt.Errorf("failed reading manifest %s %v\n", src.fileName, err)
+        }
+        if first {
+            first = false
+            header, err := src.resolveColumns(record, &keyIndex, &versionIndex)
+            if err != nil {
+                return err
+            }
+            if header {
+                continue
+            }
+        }
+        if keyIndex >= len(record) || len(record[keyIndex]) == 0 {
+            continue
+        }
+        object := &objectEntry{Key: record[keyIndex]}
+        if src.format == manifestS3Inventory {
+            if object.Key, err = url.QueryUnescape(object.Key); err != nil {
+                return fmt.Errorf("invalid key in manifest %s %v\n", src.fileName, err)
+            }
+        }
+        if versionIndex >= 0 && versionIndex < len(record) {
+            object.VersionId = record[versionIndex]
+        }
+        if err = visit(object); err != nil {
+            return err
+        }
+    }
+}
+
+// resolveColumns works out the key and version columns from the first row and
+// reports whether that row is a header.
+func (src *manifestKeySource) resolveColumns(first []string, keyIndex *int, versionIndex *int) (bool, error) {
+    header := false
+    if src.format == manifestCsv {
+        for _, name := range first {
+            if strings.EqualFold(strings.TrimSpace(name), "Key") {
+                header = true
+            }
+        }
+    }
+
+    lookup := func(column string) (int, error) {
+        if index, err := strconv.Atoi(column); err == nil {
+            if index < 1 {
+                return -1, fmt.Errorf("manifest column %d must be 1 or more", index)
+            }
+            return index - 1, nil
+        }
+        header = true
+        for i, name := range first {
+            if strings.EqualFold(strings.TrimSpace(name), column) {
+                return i, nil
+            }
+        }
+        return -1, fmt.Errorf("manifest %s has no column '%s'", src.fileName, column)
+    }
+
+    var err error
+    switch {
+    case len(src.keyColumn) > 0:
+        *keyIndex, err = lookup(src.keyColumn)
+    case *keyIndex < 0 && header:
+        *keyIndex, err = lookup("Key")
+    case *keyIndex < 0:
+        *keyIndex = 0
+    }
+    if err != nil {
+        return false, err
+    }
+    if len(src.versionColumn) > 0 {
+        *versionIndex, err = lookup(src.versionColumn)
+    }
+    return header, err
+}
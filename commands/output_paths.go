@@ -0,0 +1,138 @@
+package commands
+
+import (
+    "fmt"
+    "hash/crc32"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+)
+
+const (
+    collisionOverwrite = "overwrite"
+    collisionSkip = "skip"
+    collisionRename = "rename"
+)
+
+// outputPaths maps keys to local files. Without an output directory only the
+// last element of the key is used, in the current directory; with one, the
+// key's prefix structure is recreated below it.
+type outputPaths struct {
+    outDir string
+    stripPrefix string
+    onCollision string
+}
+
+func newOutputPaths(args *Arguments) (*outputPaths, error) {
+    switch args.OnCollision {
+    case collisionOverwrite, collisionSkip, collisionRename:
+    default:
+        return nil, fmt.Errorf("invalid on-collision '%s', must be one of %s, %s, %s",
+            args.OnCollision, collisionSkip, collisionOverwrite, collisionRename)
+    }
+    return &outputPaths{outDir: args.OutDir, stripPrefix: args.StripPrefix, onCollision: args.OnCollision}, nil
+}
+
+// tempDir is where partial files are written so they can be renamed into place.
+func (paths *outputPaths) tempDir() string {
+    if len(paths.outDir) == 0 {
+        return "."
+    }
+    return paths.outDir
+}
+
+// resolve returns the local path for key, refusing keys that would land
+// outside the output directory.
+func (paths *outputPaths) resolve(key string) (string, error) {
+    if len(paths.outDir) == 0 {
+        name := path.Base(key)
+        if name == "." || name == ".." || name == "/" {
+            return "", fmt.Errorf("key %s has no file name", key)
+        }
+        return name, nil
+    }
+
+    rel := strings.TrimPrefix(key, paths.stripPrefix)
+    for _, element := range strings.Split(rel, "/") {
+        if element == ".." {
+            return "", fmt.Errorf("key %s escapes the output directory", key)
+        }
+    }
+    rel = strings.TrimLeft(path.Clean("/" + rel), "/")
+    if len(rel) == 0 {
+        return "", fmt.Errorf("key %s has no file name", key)
+    }
+    local := filepath.Join(paths.outDir, filepath.FromSlash(rel))
+    within, err := filepath.Rel(paths.outDir, local)
+    if err != nil || within == ".." || strings.HasPrefix(within, ".." + string(filepath.Separator)) {
+        return "", fmt.Errorf("key %s escapes the output directory", key)
+    }
+    return local, nil
+}
+
+// prepare resolves key and creates its directory. skip is set when the file
+// exists and the policy is skip.
+func (paths *outputPaths) prepare(key string) (target string, skip bool, err error) {
+    target, err = paths.resolve(key)
+    if err != nil {
+        return "", false, err
+    }
+    if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+        return "", false, err
+    }
+    if paths.onCollision == collisionSkip {
+        if _, err = os.Stat(target); err == nil {
+            return target, true, nil
+        }
+    }
+    return target, false, nil
+}
+
+// skipExisting reports whether key already has a file the skip policy would
+// keep, so the work of fetching it can be avoided before it starts.
+func (paths *outputPaths) skipExisting(key string) (string, bool) {
+    if paths.onCollision != collisionSkip {
+        return "", false
+    }
+    target, err := paths.resolve(key)
+    if err != nil {
+        return "", false
+    }
+    _, err = os.Stat(target)
+    return target, err == nil
+}
+
+// partPath is where key is written until it is complete. The name includes a
+// hash of the key so two keys with the same target never share partial data,
+// and is stable so an interrupted download can be continued.
+func (paths *outputPaths) partPath(target string, key string) string {
+    return fmt.Sprintf("%s.%08x.part", target, crc32.ChecksumIEEE([]byte(key)))
+}
+
+// place renames a finished part file to target, applying the collision policy.
+// With rename the first free name is claimed with an empty placeholder so
+// concurrent downloads cannot pick the same one.
+func (paths *outputPaths) place(part string, target string) (string, error) {
+    if paths.onCollision != collisionRename {
+        return target, os.Rename(part, target)
+    }
+    ext := filepath.Ext(target)
+    base := strings.TrimSuffix(target, ext)
+    candidate := target
+    for i := 1; ; i++ {
+        f, err := os.OpenFile(candidate, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+        if err == nil {
+            f.Close()
+            if err = os.Rename(part, candidate); err != nil {
+                os.Remove(candidate)
+                return "", err
+            }
+            return candidate, nil
+        }
+        if !os.IsExist(err) {
+            return "", err
+        }
+        candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+    }
+}
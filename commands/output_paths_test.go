@@ -0,0 +1,54 @@
+package commands
+
+import (
+    "path/filepath"
+    "testing"
+)
+
+func TestOutputPathsResolve(t *testing.T) {
+    tests := []struct {
+        name string
+        outDir string
+        stripPrefix string
+        key string
+        want string
+        wantErr bool
+    }{
+        {"base name only", "", "", "projects/2021/a.mov", "a.mov", false},
+        {"no out dir, dot dot", "", "", "..", "", true},
+        {"no out dir, empty", "", "", "", "", true},
+        {"no out dir, slash", "", "", "/", "", true},
+
+        {"hierarchy", "out", "", "projects/2021/a.mov", filepath.Join("out", "projects", "2021", "a.mov"), false},
+        {"leading slash", "out", "", "/projects/a.mov", filepath.Join("out", "projects", "a.mov"), false},
+        {"leading slashes", "out", "", "//etc/passwd", filepath.Join("out", "etc", "passwd"), false},
+        {"double slash", "out", "", "a//b.txt", filepath.Join("out", "a", "b.txt"), false},
+        {"dot element", "out", "", "a/./b.txt", filepath.Join("out", "a", "b.txt"), false},
+        {"dots in a name", "out", "", "a/..b/c.txt", filepath.Join("out", "a", "..b", "c.txt"), false},
+        {"dot dot first", "out", "", "../b.txt", "", true},
+        {"dot dot inside", "out", "", "a/../../b.txt", "", true},
+        {"dot dot back in", "out", "", "a/../b.txt", "", true},
+        {"dot dot last", "out", "", "a/..", "", true},
+        {"leading slash then dot dot", "out", "", "/../b.txt", "", true},
+        {"directory only", "out", "", "/", "", true},
+
+        {"strip prefix", "out", "projects/", "projects/2021/a.mov", filepath.Join("out", "2021", "a.mov"), false},
+        {"strip prefix not there", "out", "projects/", "other/a.mov", filepath.Join("out", "other", "a.mov"), false},
+        {"strip whole key", "out", "projects/a.mov", "projects/a.mov", "", true},
+        {"strip leaves dot dot", "out", "projects/", "projects/../b.txt", "", true},
+        {"strip leaves leading slash", "out", "projects", "projects/a.mov", filepath.Join("out", "a.mov"), false},
+    }
+    for _, test := range tests {
+        paths := &outputPaths{outDir: test.outDir, stripPrefix: test.stripPrefix, onCollision: collisionOverwrite}
+        got, err := paths.resolve(test.key)
+        if test.wantErr {
+            if err == nil {
+                t.Errorf("%s: resolve(%q) = %q, want an error", test.name, test.key, got)
+            }
+            continue
+        }
+        if err != nil || got != test.want {
+            t.Errorf("%s: resolve(%q) = %q, %v, want %q", test.name, test.key, got, err, test.want)
+        }
+    }
+}
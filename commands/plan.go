@@ -0,0 +1,303 @@
+package commands
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/csv"
+    "encoding/hex"
+    "fmt"
+    "github.com/SpectraLogic/glacier_recover/client"
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "hash"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    planChecksum = "sha256"
+    planSignature = "hmac-sha256"
+)
+
+const (
+    planDeleted = "deleted"
+    planChanged = "changed"
+    planMissing = "missing"
+    planFailed = "failed"
+)
+
+var planHeader = []string{"Bucket", "Key", "Version Id", "Size", "ETag", "Last Modified", "Category", "Reason"}
+
+var applyPlanHeader = []string{"Key", "Version Id", "Action", "Detail", "Retries"}
+
+// planSumPath is the sidecar holding the plan's checksum or signature.
+func planSumPath(planFile string) string {
+    return planFile + ".sum"
+}
+
+// readPlanKey loads the HMAC key for signing plans, if --plan-key-file is set.
+func readPlanKey(args *Arguments) ([]byte, error) {
+    if len(args.PlanKeyFile) == 0 {
+        return nil, nil
+    }
+    key, err := os.ReadFile(args.PlanKeyFile)
+    if err != nil {
+        return nil, fmt.Errorf("Could not read plan key %s\n%v\n", args.PlanKeyFile, err)
+    }
+    key = bytes.TrimSpace(key)
+    if len(key) == 0 {
+        return nil, fmt.Errorf("plan key %s is empty", args.PlanKeyFile)
+    }
+    return key, nil
+}
+
+func newPlanHash(key []byte) (hash.Hash, string) {
+    if key == nil {
+        return sha256.New(), planChecksum
+    }
+    return hmac.New(sha256.New, key), planSignature
+}
+
+// planWriter records the objects test_byte_restore would delete, with the
+// ETag and LastModified they had, as CSV for review. On Close the SHA-256 of
+// the file, or its HMAC with a plan key, is written next to it so apply_plan
+// can tell if the plan was edited.
+type planWriter struct {
+    mu sync.Mutex
+    svc *s3.S3
+    bucket string
+    fileName string
+    file *os.File
+    csv *csv.Writer
+    hash hash.Hash
+    algorithm string
+    rows int
+}
+
+func newPlanWriter(svc *s3.S3, args *Arguments) (*planWriter, error) {
+    key, err := readPlanKey(args)
+    if err != nil {
+        return nil, err
+    }
+    f, err := os.Create(args.Plan)
+    if err != nil {
+        return nil, fmt.Errorf("Could not create %s\n%v\n", args.Plan, err)
+    }
+    plan := &planWriter{svc: svc, bucket: args.Bucket, fileName: args.Plan, file: f}
+    plan.hash, plan.algorithm = newPlanHash(key)
+    plan.csv = csv.NewWriter(io.MultiWriter(f, plan.hash))
+    if err = plan.csv.Write(planHeader); err != nil {
+        f.Close()
+        return nil, err
+    }
+    return plan, nil
+}
+
+// Add puts a failing object in the plan, for VailClient.OnFail.
+func (plan *planWriter) Add(key string, versionId string, category string, reason string) (string, error) {
+    head, err := plan.svc.HeadObject(
+        &s3.HeadObjectInput{
+            Bucket: aws.String(plan.bucket),
+            Key:  aws.String(key),
+            VersionId: optionalString(versionId)})
+    if err != nil {
+        return "", fmt.Errorf("not planned, HEAD failed %v", err)
+    }
+    plan.mu.Lock()
+    defer plan.mu.Unlock()
+    plan.rows++
+    err = plan.csv.Write([]string{plan.bucket, key, versionId,
+        strconv.FormatInt(aws.Int64Value(head.ContentLength), 10),
+        aws.StringValue(head.ETag),
+        aws.TimeValue(head.LastModified).UTC().Format(time.RFC3339),
+        category,
+        // one line per object keeps the plan easy to review
+        strings.Join(strings.Fields(reason), " ")})
+    if err != nil {
+        return "", err
+    }
+    return "Planned", nil
+}
+
+func (plan *planWriter) Close() error {
+    plan.mu.Lock()
+    defer plan.mu.Unlock()
+    plan.csv.Flush()
+    if err := plan.csv.Error(); err != nil {
+        plan.file.Close()
+        return err
+    }
+    if err := plan.file.Close(); err != nil {
+        return err
+    }
+    sum := fmt.Sprintf("%s %s\n", plan.algorithm, hex.EncodeToString(plan.hash.Sum(nil)))
+    if err := os.WriteFile(planSumPath(plan.fileName), []byte(sum), 0644); err != nil {
+        return fmt.Errorf("Could not write %s\n%v\n", planSumPath(plan.fileName), err)
+    }
+    fmt.Fprintf(statusOut, "Plan: %d objects to delete in %s, review it and run apply_plan\n", plan.rows, plan.fileName)
+    return nil
+}
+
+// readPlan checks the plan against its sidecar and returns its objects. A
+// plan key, when given, must have signed the plan.
+func readPlan(args *Arguments) (string, []*objectEntry, error) {
+    key, err := readPlanKey(args)
+    if err != nil {
+        return "", nil, err
+    }
+    data, err := os.ReadFile(args.Plan)
+    if err != nil {
+        return "", nil, fmt.Errorf("Could not read plan %s\n%v\n", args.Plan, err)
+    }
+    sum, err := os.ReadFile(planSumPath(args.Plan))
+    if err != nil {
+        return "", nil, fmt.Errorf("Could not read plan checksum %s\n%v\n", planSumPath(args.Plan), err)
+    }
+    fields := strings.Fields(string(sum))
+    if len(fields) != 2 {
+        return "", nil, fmt.Errorf("invalid plan checksum %s", planSumPath(args.Plan))
+    }
+    if key != nil && fields[0] != planSignature {
+        return "", nil, fmt.Errorf("plan %s is not signed", args.Plan)
+    }
+    if key == nil && fields[0] == planSignature {
+        return "", nil, fmt.Errorf("plan %s is signed, pass --plan-key-file", args.Plan)
+    }
+    if fields[0] != planChecksum && fields[0] != planSignature {
+        return "", nil, fmt.Errorf("unknown plan checksum '%s'", fields[0])
+    }
+    h, _ := newPlanHash(key)
+    h.Write(data)
+    expected, err := hex.DecodeString(fields[1])
+    if err != nil || !hmac.Equal(h.Sum(nil), expected) {
+        return "", nil, fmt.Errorf("plan %s does not match %s, it has been changed since it was made",
+            args.Plan, planSumPath(args.Plan))
+    }
+
+    records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+    if err != nil {
+        return "", nil, fmt.Errorf("invalid plan %s %v", args.Plan, err)
+    }
+    if len(records) == 0 || strings.Join(records[0], ",") != strings.Join(planHeader, ",") {
+        return "", nil, fmt.Errorf("%s is not a plan", args.Plan)
+    }
+    bucket := ""
+    objects := []*objectEntry{}
+    for _, record := range records[1:] {
+        if len(bucket) > 0 && record[0] != bucket {
+            return "", nil, fmt.Errorf("plan %s covers more than one bucket", args.Plan)
+        }
+        bucket = record[0]
+        size, err := strconv.ParseInt(record[3], 10, 64)
+        if err != nil {
+            return "", nil, fmt.Errorf("invalid size for %s in plan, %v", record[1], err)
+        }
+        lastModified, err := time.Parse(time.RFC3339, record[5])
+        if err != nil {
+            return "", nil, fmt.Errorf("invalid last modified for %s in plan, %v", record[1], err)
+        }
+        objects = append(objects, &objectEntry{Key: record[1], VersionId: record[2], Size: size,
+            ETag: record[4], LastModified: lastModified})
+    }
+    return bucket, objects, nil
+}
+
+// applyPlan deletes exactly the objects in a plan, each only after HEAD shows
+// the same ETag, LastModified and size it had when the plan was made.
+func applyPlan(svc *s3.S3, args *Arguments) error {
+    if len(args.Plan) == 0 {
+        return fmt.Errorf("apply_plan requires --plan")
+    }
+    bucket, objects, err := readPlan(args)
+    if err != nil {
+        return err
+    }
+    if len(objects) == 0 {
+        fmt.Fprintf(statusOut, "Plan %s is empty\n", args.Plan)
+        return nil
+    }
+    if len(args.Bucket) > 0 && args.Bucket != bucket {
+        return fmt.Errorf("plan %s is for bucket %s, not %s", args.Plan, bucket, args.Bucket)
+    }
+    versioned := false
+    if !args.DeleteMarker {
+        if versioned, err = bucketVersioned(svc, bucket); err != nil {
+            return err
+        }
+    }
+    report, err := newReportWriter(args.OutputFile, args.Format, applyPlanHeader)
+    if err != nil {
+        return err
+    }
+
+    var countsLock sync.Mutex
+    counts := map[string]int{}
+    result, err := newWorkerPool(args.Concurrency).Run(listKeySource(objects), func(object *objectEntry) error {
+        action, detail := applyPlanEntry(svc, bucket, object, versioned)
+        countsLock.Lock()
+        counts[action]++
+        countsLock.Unlock()
+        if err := report.Write(object.Key, object.VersionId, action, detail,
+            client.TakeRetries(svc, object.Key, object.VersionId)); err != nil {
+            return err
+        }
+        if action == planFailed {
+            return fmt.Errorf("%s", detail)
+        }
+        return nil
+    })
+    closeErr := report.Close()
+    if err != nil {
+        return err
+    }
+    if closeErr != nil {
+        return closeErr
+    }
+    fmt.Fprintf(statusOut, "apply_plan: %s=%d %s=%d %s=%d %s=%d\n", planDeleted, counts[planDeleted],
+        planChanged, counts[planChanged], planMissing, counts[planMissing], planFailed, counts[planFailed])
+    if len(result.Failed) > 0 {
+        return fmt.Errorf("apply_plan failed for %d objects", len(result.Failed))
+    }
+    return nil
+}
+
+func applyPlanEntry(svc *s3.S3, bucket string, object *objectEntry, versioned bool) (string, string) {
+    head, err := svc.HeadObject(
+        &s3.HeadObjectInput{
+            Bucket: aws.String(bucket),
+            Key:  aws.String(object.Key),
+            VersionId: optionalString(object.VersionId)})
+    if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+        return planMissing, "object no longer exists, skipped"
+    }
+    if err != nil {
+        return planFailed, fmt.Sprintf("HEAD failed %v", err)
+    }
+    changes := []string{}
+    if etag := aws.StringValue(head.ETag); etag != object.ETag {
+        changes = append(changes, fmt.Sprintf("ETag %s now %s", object.ETag, etag))
+    }
+    if lastModified := aws.TimeValue(head.LastModified); !lastModified.Equal(object.LastModified) {
+        changes = append(changes, fmt.Sprintf("Last Modified %s now %s",
+            object.LastModified.Format(time.RFC3339), lastModified.UTC().Format(time.RFC3339)))
+    }
+    if size := aws.Int64Value(head.ContentLength); size != object.Size {
+        changes = append(changes, fmt.Sprintf("Size %d now %d", object.Size, size))
+    }
+    if len(changes) > 0 {
+        return planChanged, strings.Join(changes, "; ") + ", skipped"
+    }
+    if versioned && len(object.VersionId) == 0 {
+        return planFailed, "bucket is versioned and the plan has no version id, not deleted"
+    }
+    if err = doDeleteObject(svc, bucket, object.Key, object.VersionId); err != nil {
+        return planFailed, strings.TrimSpace(err.Error())
+    }
+    return planDeleted, ""
+}
@@ -0,0 +1,217 @@
+package commands
+
+import (
+    "encoding/csv"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/credentials"
+    "github.com/aws/aws-sdk-go/aws/session"
+    "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeS3 is an S3 client talking to handler, without retries.
+func fakeS3(t *testing.T, handler http.HandlerFunc) *s3.S3 {
+    server := httptest.NewServer(handler)
+    t.Cleanup(server.Close)
+    sess := session.Must(session.NewSession(&aws.Config{
+        Endpoint: aws.String(server.URL),
+        Region: aws.String("us-east-1"),
+        S3ForcePathStyle: aws.Bool(true),
+        Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+        MaxRetries: aws.Int(0)}))
+    return s3.New(sess)
+}
+
+// writePlan writes rows under the plan header, and its sidecar as planWriter
+// does, signed when key is set.
+func writePlan(t *testing.T, fileName string, rows [][]string, key []byte) {
+    f, err := os.Create(fileName)
+    if err != nil {
+        t.Fatal(err)
+    }
+    w := csv.NewWriter(f)
+    w.Write(planHeader)
+    w.WriteAll(rows)
+    f.Close()
+    data, _ := os.ReadFile(fileName)
+    h, algorithm := newPlanHash(key)
+    h.Write(data)
+    sum := fmt.Sprintf("%s %s\n", algorithm, hex.EncodeToString(h.Sum(nil)))
+    if err = os.WriteFile(planSumPath(fileName), []byte(sum), 0644); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestReadPlan(t *testing.T) {
+    dir := t.TempDir()
+    keyFile := filepath.Join(dir, "plan.key")
+    os.WriteFile(keyFile, []byte("secret\n"), 0600)
+    otherKeyFile := filepath.Join(dir, "other.key")
+    os.WriteFile(otherKeyFile, []byte("other"), 0600)
+
+    row := []string{"bucket", "a/b.txt", "v1", "10", "\"etag\"", "2022-05-02T10:15:04Z", "data-missing", "NoSuchKey"}
+    tests := []struct {
+        name string
+        rows [][]string
+        signed bool
+        keyFile string
+        // change edits the plan or its sidecar once written
+        change func(plan string)
+        wantErr string
+        want int
+    }{
+        {name: "checksum", rows: [][]string{row, row}, want: 2},
+        {name: "signed", rows: [][]string{row}, signed: true, keyFile: keyFile, want: 1},
+        {name: "empty", want: 0},
+        {name: "row edited", rows: [][]string{row}, change: func(plan string) {
+            data, _ := os.ReadFile(plan)
+            os.WriteFile(plan, []byte(strings.Replace(string(data), "a/b.txt", "a/c.txt", 1)), 0644)
+        }, wantErr: "has been changed"},
+        {name: "row added", rows: [][]string{row}, change: func(plan string) {
+            f, _ := os.OpenFile(plan, os.O_APPEND|os.O_WRONLY, 0644)
+            f.WriteString("bucket,important.db,,1,\"e\",2022-05-02T10:15:04Z,data-missing,x\n")
+            f.Close()
+        }, wantErr: "has been changed"},
+        {name: "signed plan edited", rows: [][]string{row}, signed: true, keyFile: keyFile, change: func(plan string) {
+            data, _ := os.ReadFile(plan)
+            os.WriteFile(plan, []byte(strings.Replace(string(data), "v1", "v2", 1)), 0644)
+        }, wantErr: "has been changed"},
+        {name: "checksum recomputed for a signed plan", rows: [][]string{row}, signed: true, keyFile: keyFile, change: func(plan string) {
+            writePlan(t, plan, [][]string{row, row}, nil)
+        }, wantErr: "is not signed"},
+        {name: "signed plan without key", rows: [][]string{row}, signed: true, wantErr: "pass --plan-key-file"},
+        {name: "signed with another key", rows: [][]string{row}, signed: true, keyFile: otherKeyFile, wantErr: "has been changed"},
+        {name: "unknown algorithm", rows: [][]string{row}, change: func(plan string) {
+            os.WriteFile(planSumPath(plan), []byte("md5 0123\n"), 0644)
+        }, wantErr: "unknown plan checksum"},
+        {name: "malformed sidecar", rows: [][]string{row}, change: func(plan string) {
+            os.WriteFile(planSumPath(plan), []byte("sha256\n"), 0644)
+        }, wantErr: "invalid plan checksum"},
+        {name: "missing sidecar", rows: [][]string{row}, change: func(plan string) {
+            os.Remove(planSumPath(plan))
+        }, wantErr: "Could not read plan checksum"},
+        {name: "not a plan", change: func(plan string) {
+            os.WriteFile(plan, []byte("Key,Size\na,1\n"), 0644)
+            h, algorithm := newPlanHash(nil)
+            h.Write([]byte("Key,Size\na,1\n"))
+            os.WriteFile(planSumPath(plan), []byte(algorithm + " " + hex.EncodeToString(h.Sum(nil))), 0644)
+        }, wantErr: "is not a plan"},
+        {name: "two buckets", rows: [][]string{row, append([]string{"other"}, row[1:]...)}, wantErr: "more than one bucket"},
+        {name: "bad size", rows: [][]string{append(append([]string{}, row[:3]...), append([]string{"ten"}, row[4:]...)...)},
+            wantErr: "invalid size"},
+        {name: "bad date", rows: [][]string{append(append([]string{}, row[:5]...), "yesterday", row[6], row[7])},
+            wantErr: "invalid last modified"},
+    }
+    for i, test := range tests {
+        plan := filepath.Join(dir, "plan" + strconv.Itoa(i) + ".csv")
+        var key []byte
+        if test.signed {
+            key = []byte("secret")
+        }
+        writePlan(t, plan, test.rows, key)
+        if test.change != nil {
+            test.change(plan)
+        }
+        bucket, objects, err := readPlan(&Arguments{Plan: plan, PlanKeyFile: test.keyFile})
+        if len(test.wantErr) > 0 {
+            if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+                t.Errorf("%s: readPlan error %v, want one containing %q", test.name, err, test.wantErr)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: readPlan error %v", test.name, err)
+            continue
+        }
+        if len(objects) != test.want {
+            t.Errorf("%s: readPlan gave %d objects, want %d", test.name, len(objects), test.want)
+            continue
+        }
+        if test.want > 0 {
+            object := objects[0]
+            modified, _ := time.Parse(time.RFC3339, row[5])
+            if bucket != "bucket" || object.Key != "a/b.txt" || object.VersionId != "v1" || object.Size != 10 ||
+                object.ETag != "\"etag\"" || !object.LastModified.Equal(modified) {
+                t.Errorf("%s: readPlan = %s %+v", test.name, bucket, object)
+            }
+        }
+    }
+}
+
+func TestApplyPlanEntry(t *testing.T) {
+    modified := time.Date(2022, 5, 2, 10, 15, 4, 0, time.UTC)
+    planned := objectEntry{Key: "a.txt", VersionId: "v1", Size: 10, ETag: "\"etag\"", LastModified: modified}
+
+    type headResponse struct {
+        status int
+        etag string
+        size int
+        modified time.Time
+    }
+    same := headResponse{http.StatusOK, "\"etag\"", 10, modified}
+    tests := []struct {
+        name string
+        head headResponse
+        noVersionId bool
+        versioned bool
+        want string
+        wantDelete bool
+    }{
+        {name: "unchanged", head: same, want: planDeleted, wantDelete: true},
+        {name: "etag changed", head: headResponse{http.StatusOK, "\"other\"", 10, modified}, want: planChanged},
+        {name: "rewritten later", head: headResponse{http.StatusOK, "\"etag\"", 10, modified.Add(time.Second)}, want: planChanged},
+        {name: "size changed", head: headResponse{http.StatusOK, "\"etag\"", 11, modified}, want: planChanged},
+        {name: "gone", head: headResponse{status: http.StatusNotFound}, want: planMissing},
+        {name: "head denied", head: headResponse{status: http.StatusForbidden}, want: planFailed},
+        {name: "versioned without version id", head: same, noVersionId: true, versioned: true, want: planFailed},
+        {name: "versioned with version id", head: same, versioned: true, want: planDeleted, wantDelete: true},
+        {name: "unversioned without version id", head: same, noVersionId: true, want: planDeleted, wantDelete: true},
+    }
+    for _, test := range tests {
+        var mu sync.Mutex
+        deleted := false
+        svc := fakeS3(t, func(w http.ResponseWriter, r *http.Request) {
+            switch r.Method {
+            case http.MethodHead:
+                if test.head.status != http.StatusOK {
+                    w.WriteHeader(test.head.status)
+                    return
+                }
+                w.Header().Set("ETag", test.head.etag)
+                w.Header().Set("Content-Length", strconv.Itoa(test.head.size))
+                w.Header().Set("Last-Modified", test.head.modified.Format(http.TimeFormat))
+            case http.MethodDelete:
+                mu.Lock()
+                deleted = true
+                mu.Unlock()
+                w.WriteHeader(http.StatusNoContent)
+            default:
+                w.WriteHeader(http.StatusMethodNotAllowed)
+            }
+        })
+        object := planned
+        if test.noVersionId {
+            object.VersionId = ""
+        }
+        action, detail := applyPlanEntry(svc, "bucket", &object, test.versioned)
+        if action != test.want {
+            t.Errorf("%s: applyPlanEntry = %s (%s), want %s", test.name, action, detail, test.want)
+        }
+        mu.Lock()
+        if deleted != test.wantDelete {
+            t.Errorf("%s: deleted = %v, want %v", test.name, deleted, test.wantDelete)
+        }
+        mu.Unlock()
+    }
+}
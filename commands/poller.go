@@ -0,0 +1,154 @@
+package commands
+
+import (
+    "errors"
+    "fmt"
+    "github.com/SpectraLogic/glacier_recover/client"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "math/rand"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+const defaultPollInterval = time.Minute
+const defaultPollJitter = 15 * time.Second
+const defaultPollRate = 50
+const defaultWaitTimeout = 48 * time.Hour
+
+// errNoRestore is an archived key with neither a restore in progress nor a
+// restored copy, as when its restored copy has expired.
+var errNoRestore = errors.New("no restore in progress or restored copy")
+
+// restorePoller watches a set of keys until their restores complete. Each
+// round HEADs every key still pending, at most rate per second across all
+// workers, then sleeps interval plus or minus jitter before the next round.
+type restorePoller struct {
+    svc *s3.S3
+    bucket string
+    interval time.Duration
+    jitter time.Duration
+    rate float64
+    timeout time.Duration
+    concurrency int
+}
+
+func newRestorePoller(svc *s3.S3, args *Arguments) *restorePoller {
+    return &restorePoller{
+        svc: svc,
+        bucket: args.Bucket,
+        interval: args.PollInterval,
+        jitter: args.PollJitter,
+        rate: args.PollRate,
+        timeout: args.WaitTimeout,
+        concurrency: args.Concurrency,
+    }
+}
+
+// Wait polls until every key is restored or has failed, or the timeout
+// passes, calling ready or failed once for each key as it is settled. Checks
+// that are throttled or hit network trouble leave the key pending. It
+// returns the keys still pending at the deadline, sorted.
+func (poller *restorePoller) Wait(keys []string, ready func(key string), failed func(key string, err error)) []string {
+    pending := make(map[string]bool, len(keys))
+    for _, key := range keys {
+        pending[key] = true
+    }
+    var deadline time.Time
+    if poller.timeout > 0 {
+        deadline = time.Now().Add(poller.timeout)
+    }
+
+    for round := 1; len(pending) > 0; round++ {
+        poller.round(pending, ready, failed)
+        if len(pending) == 0 {
+            break
+        }
+        sleep := poller.interval
+        if poller.jitter > 0 {
+            sleep += time.Duration(rand.Int63n(int64(2 * poller.jitter))) - poller.jitter
+        }
+        if !deadline.IsZero() && time.Now().Add(sleep).After(deadline) {
+            break
+        }
+        fmt.Fprintf(statusOut, "Waiting on %d keys after round %d, next check %s\n",
+            len(pending), round, time.Now().Add(sleep).Format(time.RFC3339))
+        time.Sleep(sleep)
+    }
+
+    remaining := make([]string, 0, len(pending))
+    for key := range pending {
+        remaining = append(remaining, key)
+    }
+    sort.Strings(remaining)
+    return remaining
+}
+
+// round HEADs every pending key once and removes the settled ones.
+func (poller *restorePoller) round(pending map[string]bool, ready func(key string), failed func(key string, err error)) {
+    var throttle <-chan time.Time
+    if poller.rate > 0 {
+        ticker := time.NewTicker(time.Duration(float64(time.Second) / poller.rate))
+        defer ticker.Stop()
+        throttle = ticker.C
+    }
+
+    keys := make(chan string)
+    var lock sync.Mutex
+    var wg sync.WaitGroup
+    workers := poller.concurrency
+    if workers < 1 {
+        workers = 1
+    }
+    for i := 0; i < workers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for key := range keys {
+                if throttle != nil {
+                    <-throttle
+                }
+                status := headRestoreStatus(poller.svc, poller.bucket, key, "")
+                var err error
+                switch status.State {
+                case restoreInProgress:
+                    continue
+                case restoreRestored:
+                case restoreNotRequested:
+                    err = fmt.Errorf("%w for %s", errNoRestore, key)
+                case restoreNotArchived:
+                    err = fmt.Errorf("%s is %s, not archived", key, status.StorageClass)
+                default:
+                    err = status.Err
+                    // throttling and network trouble say nothing about the restore
+                    switch client.ClassifyError(err) {
+                    case client.CategoryThrottled, client.CategoryTransient:
+                        fmt.Fprintf(statusOut, "Check of %s failed, trying again next round: %v\n", key, strings.Join(strings.Fields(err.Error()), " "))
+                        continue
+                    }
+                }
+                lock.Lock()
+                delete(pending, key)
+                lock.Unlock()
+                if err != nil {
+                    failed(key, err)
+                } else {
+                    ready(key)
+                }
+            }
+        }()
+    }
+
+    lock.Lock()
+    round := make([]string, 0, len(pending))
+    for key := range pending {
+        round = append(round, key)
+    }
+    lock.Unlock()
+    for _, key := range round {
+        keys <- key
+    }
+    close(keys)
+    wg.Wait()
+}
@@ -0,0 +1,87 @@
+package commands
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+)
+
+const defaultConcurrency = 10
+
+// keyError records the failure of a single key.
+type keyError struct {
+    Key string
+    Err error
+}
+
+// poolResult collects the outcome of every task a workerPool ran.
+type poolResult struct {
+    mu sync.Mutex
+    Succeeded []string
+    Failed []keyError
+}
+
+func (result *poolResult) add(key string, err error) {
+    result.mu.Lock()
+    defer result.mu.Unlock()
+    if err != nil {
+        result.Failed = append(result.Failed, keyError{key, err})
+    } else {
+        result.Succeeded = append(result.Succeeded, key)
+    }
+}
+
+// PrintSummary reports the succeeded and failed counts, then each failed key.
+func (result *poolResult) PrintSummary(operation string) {
+    result.mu.Lock()
+    defer result.mu.Unlock()
+    fmt.Fprintf(statusOut, "%s: %d succeeded, %d failed\n", operation, len(result.Succeeded), len(result.Failed))
+    sort.Slice(result.Failed, func(i, j int) bool { return result.Failed[i].Key < result.Failed[j].Key })
+    for _, failed := range result.Failed {
+        fmt.Fprintf(statusOut, "  FAILED %s: %v\n", failed.Key, failed.Err)
+    }
+}
+
+// workerPool runs a task for every object a keySource produces with at most
+// concurrency tasks in flight.
+type workerPool struct {
+    concurrency int
+}
+
+func newWorkerPool(concurrency int) *workerPool {
+    if concurrency < 1 {
+        concurrency = 1
+    }
+    return &workerPool{concurrency: concurrency}
+}
+
+// Run walks source and hands each object to task; objects the source could
+// not look up are recorded as failed without running task. It returns once
+// every task has finished; the error is only set if the source itself failed.
+func (pool *workerPool) Run(source keySource, task func(*objectEntry) error) (*poolResult, error) {
+    result := &poolResult{}
+    objects := make(chan *objectEntry, pool.concurrency)
+
+    var wg sync.WaitGroup
+    for i := 0; i < pool.concurrency; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for object := range objects {
+                if object.LookupErr != nil {
+                    result.add(versionName(object.Key, object.VersionId), object.LookupErr)
+                    continue
+                }
+                result.add(versionName(object.Key, object.VersionId), task(object))
+            }
+        }()
+    }
+
+    err := source.Walk(func(object *objectEntry) error {
+        objects <- object
+        return nil
+    })
+    close(objects)
+    wg.Wait()
+    return result, err
+}
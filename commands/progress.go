@@ -0,0 +1,68 @@
+package commands
+
+import (
+    "fmt"
+    "os"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const progressInterval = 2 * time.Second
+
+// progress keeps a line on stderr with the objects done and failed so far and
+// the rate, rewritten every progressInterval while a sweep runs, so stdout
+// stays free for the report.
+type progress struct {
+    operation string
+    start time.Time
+    done int64
+    failed int64
+    stop chan struct{}
+    wg sync.WaitGroup
+}
+
+func startProgress(operation string) *progress {
+    p := &progress{operation: operation, start: time.Now(), stop: make(chan struct{})}
+    p.wg.Add(1)
+    go func() {
+        defer p.wg.Done()
+        ticker := time.NewTicker(progressInterval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+                fmt.Fprintf(os.Stderr, "\r%s", p.line())
+            case <-p.stop:
+                return
+            }
+        }
+    }()
+    return p
+}
+
+// add counts one object done, and whether it failed.
+func (p *progress) add(failed bool) {
+    atomic.AddInt64(&p.done, 1)
+    if failed {
+        atomic.AddInt64(&p.failed, 1)
+    }
+}
+
+func (p *progress) line() string {
+    done := atomic.LoadInt64(&p.done)
+    elapsed := time.Since(p.start)
+    rate := 0.0
+    if elapsed > 0 {
+        rate = float64(done) / elapsed.Seconds()
+    }
+    return fmt.Sprintf("%s: %d tested, %d failed, %.1f/s, %s", p.operation, done,
+        atomic.LoadInt64(&p.failed), rate, elapsed.Round(time.Second))
+}
+
+// Stop ends the updates and prints the final counts.
+func (p *progress) Stop() {
+    close(p.stop)
+    p.wg.Wait()
+    fmt.Fprintf(os.Stderr, "\r%s\n", p.line())
+}
@@ -0,0 +1,446 @@
+package commands
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "github.com/SpectraLogic/glacier_recover/client"
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "io"
+    "time"
+)
+
+const (
+    quarantineTag = "tag"
+    quarantineCopy = "copy"
+    quarantineMove = "move"
+)
+
+const (
+    unrestorableTag = "vail-unrestorable"
+    quarantinedTag = "vail-quarantined"
+)
+
+const (
+    quarantineReleased = "released"
+    quarantinePurged = "purged"
+    quarantineKept = "kept"
+)
+
+var quarantineHeader = []string{"Key", "Version Id", "Size", "Storage Class", "Last Modified", "Mode",
+    "Quarantined", "Reason", "Restorable", "Category", "Action", "Error", "Retries"}
+
+// quarantineEntry is one quarantined object. With copy and move it is also
+// the JSON body of the marker object left in the quarantine location.
+type quarantineEntry struct {
+    Bucket string
+    Key string
+    VersionId string `json:",omitempty"`
+    Size int64
+    StorageClass string `json:",omitempty"`
+    LastModified time.Time
+    ETag string `json:",omitempty"`
+    Mode string
+    Quarantined time.Time
+    Category string `json:",omitempty"`
+    Reason string `json:",omitempty"`
+    // Purged is when quarantine_purge deleted the object of a move marker,
+    // which is then kept as the record of it.
+    Purged *time.Time `json:",omitempty"`
+    markerKey string
+}
+
+// row reports entry with the result of re-testing it.
+func (entry *quarantineEntry) row(restorable interface{}, category string, action string, err error, retries int) []interface{} {
+    errorString := ""
+    if err != nil {
+        errorString = fmt.Sprintf("ERR: %v", err)
+    }
+    return []interface{}{entry.Key, entry.VersionId, entry.Size, entry.StorageClass, entry.LastModified, entry.Mode,
+        entry.Quarantined, entry.Reason, restorable, category, action, errorString, retries}
+}
+
+// quarantine sets aside objects that fail test_byte_restore so they can be
+// reviewed and purged later, rather than deleted on the spot. tag marks the
+// object itself; copy and move write a marker holding its metadata to the
+// quarantine location. Nothing is deleted until quarantine_purge re-tests the
+// object; a purged move marker stays behind as the record of the object.
+type quarantine struct {
+    svc *s3.S3
+    bucket string
+    mode string
+    quarantineBucket string
+    quarantinePrefix string
+    deleteMarker bool
+    deleteCategories map[string]bool
+    verify string
+    samples int
+    sampleSize int64
+}
+
+// newQuarantine returns nil when --quarantine is not set.
+func newQuarantine(svc *s3.S3, args *Arguments) (*quarantine, error) {
+    switch args.Quarantine {
+    case "":
+        return nil, nil
+    case quarantineTag, quarantineCopy, quarantineMove:
+    default:
+        return nil, fmt.Errorf("invalid quarantine '%s', must be one of %s, %s, %s",
+            args.Quarantine, quarantineTag, quarantineCopy, quarantineMove)
+    }
+    deleteCategories, err := parseDeleteCategories(args)
+    if err != nil {
+        return nil, err
+    }
+    sampleSize, err := parseDeepVerify(args)
+    if err != nil {
+        return nil, err
+    }
+    q := &quarantine{svc: svc, bucket: args.Bucket, mode: args.Quarantine,
+        quarantineBucket: args.QuarantineBucket, quarantinePrefix: args.QuarantinePrefix,
+        deleteMarker: args.DeleteMarker, deleteCategories: deleteCategories,
+        verify: args.DeepVerify, samples: args.Samples, sampleSize: sampleSize}
+    if len(q.quarantineBucket) == 0 {
+        q.quarantineBucket = q.bucket
+    }
+    if q.mode != quarantineTag && q.quarantineBucket == q.bucket && len(q.quarantinePrefix) == 0 {
+        return nil, fmt.Errorf("quarantine %s needs --quarantine-prefix or another --quarantine-bucket", q.mode)
+    }
+    return q, nil
+}
+
+// markerKey keeps versions of a key apart in the quarantine location.
+func (q *quarantine) markerKey(key string, versionId string) string {
+    if len(versionId) == 0 {
+        return q.quarantinePrefix + key
+    }
+    return q.quarantinePrefix + key + "#" + versionId
+}
+
+// Quarantine sets aside one object that failed its test, for
+// VailClient.OnFail.
+func (q *quarantine) Quarantine(key string, versionId string, category string, reason string) (string, error) {
+    if err := q.quarantine(key, versionId, category, reason); err != nil {
+        return "", err
+    }
+    return "Quarantined", nil
+}
+
+func (q *quarantine) quarantine(key string, versionId string, category string, reason string) error {
+    if q.mode == quarantineTag {
+        return q.setTags(key, versionId, map[string]string{
+            unrestorableTag: "true",
+            quarantinedTag: time.Now().UTC().Format(time.RFC3339)})
+    }
+
+    entry := &quarantineEntry{Bucket: q.bucket, Key: key, VersionId: versionId, Mode: q.mode,
+        Quarantined: time.Now().UTC(), Category: category, Reason: reason}
+    head, err := q.svc.HeadObject(
+        &s3.HeadObjectInput{
+            Bucket: aws.String(q.bucket),
+            Key:  aws.String(key),
+            VersionId: optionalString(versionId)})
+    if err == nil {
+        entry.Size = aws.Int64Value(head.ContentLength)
+        entry.StorageClass = aws.StringValue(head.StorageClass)
+        entry.LastModified = aws.TimeValue(head.LastModified)
+        entry.ETag = aws.StringValue(head.ETag)
+    }
+    body, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    _, err = q.svc.PutObject(
+        &s3.PutObjectInput{
+            Bucket: aws.String(q.quarantineBucket),
+            Key:  aws.String(q.markerKey(key, versionId)),
+            ContentType: aws.String("application/json"),
+            Body: bytes.NewReader(body)})
+    if err != nil {
+        return fmt.Errorf("failed to write quarantine marker for %s, %v\n", versionName(key, versionId), err)
+    }
+    return nil
+}
+
+// deleteOriginal deletes the quarantined object, refusing to leave only a
+// delete marker in a versioned bucket unless --delete-marker was given.
+func (q *quarantine) deleteOriginal(key string, versionId string) error {
+    if len(versionId) == 0 && !q.deleteMarker {
+        versioned, err := bucketVersioned(q.svc, q.bucket)
+        if err != nil {
+            return err
+        }
+        if versioned {
+            return fmt.Errorf("bucket %s is versioned and %s has no version id, not deleted", q.bucket, key)
+        }
+    }
+    return doDeleteObject(q.svc, q.bucket, key, versionId)
+}
+
+// setTags adds tags to the object's tag set, or removes them when the value
+// is empty, keeping any other tags.
+func (q *quarantine) setTags(key string, versionId string, tags map[string]string) error {
+    current, err := q.svc.GetObjectTagging(
+        &s3.GetObjectTaggingInput{
+            Bucket: aws.String(q.bucket),
+            Key:  aws.String(key),
+            VersionId: optionalString(versionId)})
+    if err != nil {
+        return fmt.Errorf("failed getting tags of %s, %v\n", versionName(key, versionId), err)
+    }
+    tagSet := []*s3.Tag{}
+    for _, tag := range current.TagSet {
+        if _, ok := tags[aws.StringValue(tag.Key)]; !ok {
+            tagSet = append(tagSet, tag)
+        }
+    }
+    for name, value := range tags {
+        if len(value) > 0 {
+            tagSet = append(tagSet, &s3.Tag{Key: aws.String(name), Value: aws.String(value)})
+        }
+    }
+    if len(tagSet) == 0 {
+        _, err = q.svc.DeleteObjectTagging(
+            &s3.DeleteObjectTaggingInput{
+                Bucket: aws.String(q.bucket),
+                Key:  aws.String(key),
+                VersionId: optionalString(versionId)})
+    } else {
+        _, err = q.svc.PutObjectTagging(
+            &s3.PutObjectTaggingInput{
+                Bucket: aws.String(q.bucket),
+                Key:  aws.String(key),
+                VersionId: optionalString(versionId),
+                Tagging: &s3.Tagging{TagSet: tagSet}})
+    }
+    if err != nil {
+        return fmt.Errorf("failed setting tags of %s, %v\n", versionName(key, versionId), err)
+    }
+    return nil
+}
+
+// walk visits every quarantined object: with tag, the objects from the usual
+// key options that carry the tag; otherwise every marker in the quarantine
+// location.
+func (q *quarantine) walk(args *Arguments, visit func(*quarantineEntry) error) error {
+    if q.mode == quarantineTag {
+        source, err := keySourceFromArgs(q.svc, args)
+        if err != nil {
+            return err
+        }
+        return source.Walk(func(object *objectEntry) error {
+            // already reported failed by the filter, never released or purged
+            if object.LookupErr != nil {
+                return nil
+            }
+            tags, err := q.svc.GetObjectTagging(
+                &s3.GetObjectTaggingInput{
+                    Bucket: aws.String(q.bucket),
+                    Key:  aws.String(object.Key),
+                    VersionId: optionalString(object.VersionId)})
+            if err != nil {
+                return fmt.Errorf("failed getting tags of %s, %v\n", versionName(object.Key, object.VersionId), err)
+            }
+            entry := &quarantineEntry{Bucket: q.bucket, Key: object.Key, VersionId: object.VersionId, Size: object.Size,
+                StorageClass: object.StorageClass, LastModified: object.LastModified, ETag: object.ETag, Mode: q.mode}
+            unrestorable := false
+            for _, tag := range tags.TagSet {
+                switch aws.StringValue(tag.Key) {
+                case unrestorableTag:
+                    unrestorable = aws.StringValue(tag.Value) == "true"
+                case quarantinedTag:
+                    entry.Quarantined, _ = time.Parse(time.RFC3339, aws.StringValue(tag.Value))
+                }
+            }
+            if !unrestorable {
+                return nil
+            }
+            return visit(entry)
+        })
+    }
+
+    var visitErr error
+    err := q.svc.ListObjectsV2Pages(
+        &s3.ListObjectsV2Input{
+            Bucket: aws.String(q.quarantineBucket),
+            Prefix: aws.String(q.quarantinePrefix),
+            MaxKeys: aws.Int64(1000)},
+        func(resp *s3.ListObjectsV2Output, more bool) bool {
+            for _, object := range resp.Contents {
+                var entry *quarantineEntry
+                entry, visitErr = q.readMarker(aws.StringValue(object.Key))
+                if visitErr == nil && entry.Purged == nil {
+                    visitErr = visit(entry)
+                }
+                if visitErr != nil {
+                    return false
+                }
+            }
+            return true
+        })
+    if err != nil {
+        return fmt.Errorf("failed listing quarantine %s/%s %v\n", q.quarantineBucket, q.quarantinePrefix, err)
+    }
+    return visitErr
+}
+
+func (q *quarantine) readMarker(markerKey string) (*quarantineEntry, error) {
+    result, err := q.svc.GetObject(
+        &s3.GetObjectInput{
+            Bucket: aws.String(q.quarantineBucket),
+            Key:  aws.String(markerKey)})
+    if err != nil {
+        return nil, fmt.Errorf("failed reading quarantine marker %s, %v\n", markerKey, err)
+    }
+    defer result.Body.Close()
+    body, err := io.ReadAll(result.Body)
+    if err != nil {
+        return nil, fmt.Errorf("failed reading quarantine marker %s, %v\n", markerKey, err)
+    }
+    entry := &quarantineEntry{}
+    if err = json.Unmarshal(body, entry); err != nil {
+        return nil, fmt.Errorf("%s is not a quarantine marker, %v\n", markerKey, err)
+    }
+    if entry.Bucket != q.bucket {
+        return nil, fmt.Errorf("quarantine marker %s is for bucket %s, not %s\n", markerKey, entry.Bucket, q.bucket)
+    }
+    entry.markerKey = markerKey
+    return entry, nil
+}
+
+// release takes entry out of quarantine.
+func (q *quarantine) release(entry *quarantineEntry) error {
+    if entry.Mode == quarantineTag {
+        return q.setTags(entry.Key, entry.VersionId, map[string]string{unrestorableTag: "", quarantinedTag: ""})
+    }
+    _, err := q.svc.DeleteObject(
+        &s3.DeleteObjectInput{
+            Bucket: aws.String(q.quarantineBucket),
+            Key:  aws.String(entry.markerKey)})
+    if err != nil {
+        return fmt.Errorf("failed removing quarantine marker %s, %v\n", entry.markerKey, err)
+    }
+    return nil
+}
+
+// retest reads a quarantined object again, as --deep-verify says or else its
+// first bytes, and returns whether it could, and if not the category of the
+// failure. Objects quarantined by a deep verify are always read in full, as
+// their first bytes read fine.
+func (q *quarantine) retest(entry *quarantineEntry) (interface{}, string) {
+    verify := q.verify
+    if len(verify) == 0 && (entry.Category == client.CategoryPartial || entry.Category == client.CategoryMismatch) {
+        verify = client.VerifyFull
+    }
+    var success bool
+    var err error
+    switch verify {
+    case client.VerifyFull:
+        success, _, _, err = client.ReadFull(q.svc, q.bucket, entry.Key, entry.VersionId)
+    case client.VerifySample:
+        success, _, _, err = client.ReadSamples(q.svc, q.bucket, entry.Key, entry.VersionId, q.samples, q.sampleSize)
+    default:
+        success, err = client.TestGetObject(q.svc, q.bucket, entry.Key, entry.VersionId)
+    }
+    return success, client.ClassifyError(err)
+}
+
+// quarantineReview re-tests every quarantined object and reports which can be
+// read now, without changing anything.
+func quarantineReview(svc *s3.S3, args *Arguments) error {
+    return runQuarantine(svc, args, func(q *quarantine, entry *quarantineEntry) (interface{}, string, string, error) {
+        restorable, category := q.retest(entry)
+        return restorable, category, "", nil
+    })
+}
+
+// quarantinePurge re-tests every quarantined object. Objects that read back
+// are released from quarantine; the rest are deleted if their failure is in
+// --delete-categories, and kept otherwise. The marker of a deleted object is
+// removed with copy and kept, marked purged, with move.
+func quarantinePurge(svc *s3.S3, args *Arguments) error {
+    return runQuarantine(svc, args, func(q *quarantine, entry *quarantineEntry) (interface{}, string, string, error) {
+        restorable, category := q.retest(entry)
+        if restorable == true {
+            return restorable, category, quarantineReleased, q.release(entry)
+        }
+        if !q.deleteCategories[category] {
+            return restorable, category, quarantineKept, nil
+        }
+        if err := q.deleteOriginal(entry.Key, entry.VersionId); err != nil {
+            return restorable, category, "", err
+        }
+        switch entry.Mode {
+        case quarantineTag:
+            return restorable, category, quarantinePurged, nil
+        case quarantineMove:
+            return restorable, category, quarantinePurged, q.markPurged(entry)
+        }
+        return restorable, category, quarantinePurged, q.release(entry)
+    })
+}
+
+// markPurged rewrites the marker of a move as the record of the deleted
+// object; walk passes over it from then on.
+func (q *quarantine) markPurged(entry *quarantineEntry) error {
+    purged := time.Now().UTC()
+    entry.Purged = &purged
+    body, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    _, err = q.svc.PutObject(
+        &s3.PutObjectInput{
+            Bucket: aws.String(q.quarantineBucket),
+            Key:  aws.String(entry.markerKey),
+            ContentType: aws.String("application/json"),
+            Body: bytes.NewReader(body)})
+    if err != nil {
+        return fmt.Errorf("failed to mark quarantine marker %s purged, %v\n", entry.markerKey, err)
+    }
+    return nil
+}
+
+func runQuarantine(svc *s3.S3, args *Arguments, act func(*quarantine, *quarantineEntry) (interface{}, string, string, error)) error {
+    if len(args.Quarantine) == 0 {
+        return fmt.Errorf("%s requires --quarantine %s, %s or %s", args.Command, quarantineTag, quarantineCopy, quarantineMove)
+    }
+    q, err := newQuarantine(svc, args)
+    if err != nil {
+        return err
+    }
+    report, err := newReportWriter(args.OutputFile, args.Format, quarantineHeader)
+    if err != nil {
+        return err
+    }
+    total, restorable, failed := 0, 0, 0
+    actions := map[string]int{}
+    err = q.walk(args, func(entry *quarantineEntry) error {
+        canRestore, category, action, err := act(q, entry)
+        total++
+        if canRestore == true {
+            restorable++
+        }
+        if err != nil {
+            failed++
+        } else if len(action) > 0 {
+            actions[action]++
+        }
+        return report.Write(entry.row(canRestore, category, action, err,
+            client.TakeRetries(svc, entry.Key, entry.VersionId))...)
+    })
+    closeErr := report.Close()
+    if err != nil {
+        return err
+    }
+    if closeErr != nil {
+        return closeErr
+    }
+    fmt.Fprintf(statusOut, "%s: quarantined=%d restorable=%d released=%d purged=%d kept=%d, %d failed\n", args.Command,
+        total, restorable, actions[quarantineReleased], actions[quarantinePurged], actions[quarantineKept], failed)
+    if failed > 0 {
+        return fmt.Errorf("%s failed for %d objects", args.Command, failed)
+    }
+    return nil
+}
@@ -0,0 +1,156 @@
+package commands
+
+import (
+    "fmt"
+    "github.com/SpectraLogic/glacier_recover/client"
+    "io"
+    "os"
+    "sync"
+)
+
+// reportWriter writes one record per object to a report file in the chosen
+// output format. It is safe to use from every worker in a pool, and can be
+// handed to a VailClient as its output.
+type reportWriter struct {
+    file *os.File
+    out client.RecordWriter
+}
+
+// statusOut is where progress and summary lines go: stdout, or stderr while a
+// report is written to stdout so the report can be piped on.
+var statusOut io.Writer = os.Stdout
+
+// StatusOut is where lines that are not part of a report are printed.
+func StatusOut() io.Writer {
+    return statusOut
+}
+
+// newReportWriter creates fileName, or writes to stdout if it is empty. An
+// empty format is taken from the file extension (.json, .ndjson), else CSV.
+func newReportWriter(fileName string, format string, header []string) (*reportWriter, error) {
+    format, err := client.OutputFormat(fileName, format)
+    if err != nil {
+        return nil, err
+    }
+    f := os.Stdout
+    if len(fileName) > 0 {
+        f, err = os.Create(fileName)
+        if err != nil {
+            return nil, fmt.Errorf("Could not create %s\n%v\n", fileName, err)
+        }
+    }
+    report := &reportWriter{file: f}
+    report.out, err = client.NewRecordWriter(f, format, header)
+    if err != nil {
+        report.closeFile()
+        return nil, err
+    }
+    return report, nil
+}
+
+// Write adds a record; a nil report writes nothing.
+func (report *reportWriter) Write(values ...interface{}) error {
+    if report == nil {
+        return nil
+    }
+    return report.out.Write(values...)
+}
+
+func (report *reportWriter) Close() error {
+    if report == nil {
+        return nil
+    }
+    if err := report.out.Close(); err != nil {
+        report.closeFile()
+        return err
+    }
+    return report.closeFile()
+}
+
+func (report *reportWriter) closeFile() error {
+    if report.file == os.Stdout {
+        return nil
+    }
+    return report.file.Close()
+}
+
+// orderedReport writes records in the order their objects were handed out,
+// holding back those that finish early until every earlier one is written.
+// Each object gets a reportSlot to write its records to.
+type orderedReport struct {
+    mu sync.Mutex
+    out client.RecordWriter
+    assigned map[*objectEntry]int
+    listed int
+    next int
+    finished map[int][][]interface{}
+}
+
+func newOrderedReport(out client.RecordWriter) *orderedReport {
+    return &orderedReport{out: out, assigned: map[*objectEntry]int{}, finished: map[int][][]interface{}{}}
+}
+
+// orderedKeySource numbers the objects of source for report in the order it
+// visits them.
+type orderedKeySource struct {
+    source keySource
+    report *orderedReport
+}
+
+func (src *orderedKeySource) Walk(visit func(*objectEntry) error) error {
+    return src.source.Walk(func(object *objectEntry) error {
+        // the pool reports objects that could not be looked up without a task
+        if object.LookupErr != nil {
+            return visit(object)
+        }
+        src.report.mu.Lock()
+        src.report.assigned[object] = src.report.listed
+        src.report.listed++
+        src.report.mu.Unlock()
+        return visit(object)
+    })
+}
+
+// slot is where the records of object go; Close hands them on.
+func (ordered *orderedReport) slot(object *objectEntry) *reportSlot {
+    ordered.mu.Lock()
+    defer ordered.mu.Unlock()
+    seq := ordered.assigned[object]
+    delete(ordered.assigned, object)
+    return &reportSlot{report: ordered, seq: seq}
+}
+
+func (ordered *orderedReport) finish(slot *reportSlot) error {
+    ordered.mu.Lock()
+    defer ordered.mu.Unlock()
+    ordered.finished[slot.seq] = slot.records
+    for {
+        records, ok := ordered.finished[ordered.next]
+        if !ok {
+            return nil
+        }
+        delete(ordered.finished, ordered.next)
+        ordered.next++
+        for _, record := range records {
+            if err := ordered.out.Write(record...); err != nil {
+                return err
+            }
+        }
+    }
+}
+
+// reportSlot collects the records of one object for an orderedReport.
+type reportSlot struct {
+    report *orderedReport
+    seq int
+    records [][]interface{}
+}
+
+func (slot *reportSlot) Write(values ...interface{}) error {
+    slot.records = append(slot.records, values)
+    return nil
+}
+
+func (slot *reportSlot) Close() error {
+    return slot.report.finish(slot)
+}
@@ -0,0 +1,155 @@
+package commands
+
+import (
+    "fmt"
+    "github.com/SpectraLogic/glacier_recover/client"
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "regexp"
+    "sort"
+    "sync"
+    "time"
+)
+
+const (
+    restoreNotRequested = "not-requested"
+    restoreInProgress = "in-progress"
+    restoreRestored = "restored"
+    restoreNotArchived = "not-archived"
+    restoreError = "error"
+)
+
+var restoreStatusHeader = []string{"Key", "Version Id", "Storage Class", "State", "Expiry", "Size", "Error", "Retries"}
+
+// restoreStatus is what HeadObject says about an object's restore.
+type restoreStatus struct {
+    Key string
+    VersionId string
+    StorageClass string
+    State string
+    Expiry time.Time
+    Size int64
+    Err error
+    Retries int
+}
+
+func (status *restoreStatus) row() []interface{} {
+    errorString := ""
+    if status.Err != nil {
+        errorString = fmt.Sprintf("ERR: %v", status.Err)
+    }
+    return []interface{}{status.Key, status.VersionId, status.StorageClass, status.State, status.Expiry,
+        status.Size, errorString, status.Retries}
+}
+
+var restoreHeaderField = regexp.MustCompile(`([a-z-]+)="([^"]*)"`)
+
+// parseRestoreHeader reads an x-amz-restore value such as
+// ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT".
+func parseRestoreHeader(header string) (ongoing bool, expiry time.Time, err error) {
+    for _, field := range restoreHeaderField.FindAllStringSubmatch(header, -1) {
+        switch field[1] {
+        case "ongoing-request":
+            ongoing = field[2] == "true"
+        case "expiry-date":
+            expiry, err = time.Parse(time.RFC1123, field[2])
+            if err != nil {
+                return false, time.Time{}, fmt.Errorf("invalid expiry-date '%s' %v", field[2], err)
+            }
+        }
+    }
+    return ongoing, expiry, nil
+}
+
+func restoreStatusFromHead(key string, head *s3.HeadObjectOutput) *restoreStatus {
+    status := &restoreStatus{
+        Key: key,
+        VersionId: aws.StringValue(head.VersionId),
+        StorageClass: aws.StringValue(head.StorageClass),
+        Size: aws.Int64Value(head.ContentLength),
+    }
+    // HEAD omits the storage class for STANDARD objects
+    if len(status.StorageClass) == 0 {
+        status.StorageClass = s3.StorageClassStandard
+    }
+    if status.StorageClass != s3.StorageClassGlacier && status.StorageClass != s3.StorageClassDeepArchive {
+        status.State = restoreNotArchived
+        return status
+    }
+    if head.Restore == nil {
+        status.State = restoreNotRequested
+        return status
+    }
+    ongoing, expiry, err := parseRestoreHeader(*head.Restore)
+    switch {
+    case err != nil:
+        status.State = restoreError
+        status.Err = err
+    case ongoing:
+        status.State = restoreInProgress
+    default:
+        status.State = restoreRestored
+        status.Expiry = expiry
+    }
+    return status
+}
+
+func headRestoreStatus(svc *s3.S3, bucket string, key string, versionId string) *restoreStatus {
+    head, err := svc.HeadObject(
+        &s3.HeadObjectInput{
+            Bucket: aws.String(bucket),
+            Key:  aws.String(key),
+            VersionId: optionalString(versionId)})
+    if err != nil {
+        return &restoreStatus{Key: key, VersionId: versionId, State: restoreError, Err: err,
+            Retries: client.TakeRetries(svc, key, versionId)}
+    }
+    status := restoreStatusFromHead(key, head)
+    status.Retries = client.TakeRetries(svc, key, versionId)
+    return status
+}
+
+// restoreStatusReport HEADs every key and writes its restore state, then a
+// count of keys in each state.
+func restoreStatusReport(svc *s3.S3, args *Arguments) error {
+    source, err := keySourceFromArgs(svc, args)
+    if err != nil {
+        return err
+    }
+    report, err := newReportWriter(args.OutputFile, args.Format, restoreStatusHeader)
+    if err != nil {
+        return err
+    }
+
+    var countsLock sync.Mutex
+    counts := map[string]int{}
+    _, err = newWorkerPool(args.Concurrency).Run(source, func(object *objectEntry) error {
+        status := headRestoreStatus(svc, args.Bucket, object.Key, object.VersionId)
+        countsLock.Lock()
+        counts[status.State]++
+        countsLock.Unlock()
+        if err := report.Write(status.row()...); err != nil {
+            return err
+        }
+        return status.Err
+    })
+    closeErr := report.Close()
+    if err != nil {
+        return err
+    }
+    if closeErr != nil {
+        return closeErr
+    }
+
+    states := make([]string, 0, len(counts))
+    for state := range counts {
+        states = append(states, state)
+    }
+    sort.Strings(states)
+    fmt.Fprintf(statusOut, "restore_status:")
+    for _, state := range states {
+        fmt.Fprintf(statusOut, " %s=%d", state, counts[state])
+    }
+    fmt.Fprintf(statusOut, "\n")
+    return nil
+}
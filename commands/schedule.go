@@ -0,0 +1,94 @@
+package commands
+
+import (
+    "fmt"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "sort"
+    "sync"
+    "time"
+)
+
+const defaultEstimatedBandwidthMB = 100
+
+// listKeySource yields a fixed list of objects in order.
+type listKeySource []*objectEntry
+
+func (src listKeySource) Walk(visit func(*objectEntry) error) error {
+    for _, object := range src {
+        if err := visit(object); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// scheduleDownloads HEADs every key in source and orders them by the expiry of
+// their restored copy, soonest first. Keys whose copy is expected to expire
+// before their download finishes, at the estimated bandwidth, are reported
+// and, with extend-restore, restored again for args.Days so the copy outlives
+// the transfer. Keys whose copy has already expired are reported failed; they
+// are restored again with extend-restore, and otherwise moved back in journal
+// so resume restores them again.
+func scheduleDownloads(svc *s3.S3, args *Arguments, source keySource, journal *jobJournal) (keySource, error) {
+    var lock sync.Mutex
+    statuses := []*restoreStatus{}
+    _, err := newWorkerPool(args.Concurrency).Run(source, func(object *objectEntry) error {
+        status := headRestoreStatus(svc, args.Bucket, object.Key, object.VersionId)
+        lock.Lock()
+        statuses = append(statuses, status)
+        lock.Unlock()
+        return status.Err
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    // copies without an expiry, not archived or not restored, go last
+    sort.SliceStable(statuses, func(i, j int) bool {
+        a, b := statuses[i].Expiry, statuses[j].Expiry
+        if a.IsZero() != b.IsZero() {
+            return b.IsZero()
+        }
+        return a.Before(b)
+    })
+
+    bandwidth := float64(args.EstimatedBandwidthMB) * 1024 * 1024
+    if bandwidth <= 0 {
+        bandwidth = defaultEstimatedBandwidthMB * 1024 * 1024
+    }
+    tier, err := parseTier(args.Tier)
+    if err != nil {
+        return nil, err
+    }
+
+    start := time.Now()
+    var queued int64
+    scheduled := make(listKeySource, 0, len(statuses))
+    for _, status := range statuses {
+        queued += status.Size
+        finish := start.Add(time.Duration(float64(queued) / bandwidth * float64(time.Second)))
+        object := &objectEntry{Key: status.Key, Size: status.Size, StorageClass: status.StorageClass}
+        switch status.State {
+        case restoreNotRequested:
+            fmt.Fprintf(statusOut, "WARNING: %s has no restored copy; it may have expired\n", status.Key)
+            object.LookupErr = fmt.Errorf("no restored copy to download, %w", errNoRestore)
+            if args.ExtendRestore &&
+                doRestoreObject(svc, args.Bucket, status.Key, status.VersionId, status.StorageClass, tier, args.Days) == nil {
+                object.LookupErr = fmt.Errorf("restored copy expired, restore requested again")
+                journal.Record(status.Key, stateRequested, nil)
+            } else {
+                journal.Reset(status.Key, object.LookupErr)
+            }
+        case restoreRestored:
+            if finish.After(status.Expiry) {
+                fmt.Fprintf(statusOut, "WARNING: %s expires %s, download estimated to finish %s\n",
+                    status.Key, status.Expiry.Format(time.RFC3339), finish.Format(time.RFC3339))
+                if args.ExtendRestore {
+                    doRestoreObject(svc, args.Bucket, status.Key, status.VersionId, status.StorageClass, tier, args.Days)
+                }
+            }
+        }
+        scheduled = append(scheduled, object)
+    }
+    return scheduled, nil
+}
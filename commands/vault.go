@@ -0,0 +1,143 @@
+package commands
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/SpectraLogic/glacier_recover/client"
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/glacier"
+    "time"
+)
+
+// vaultInventoryOutput is the JSON document an inventory-retrieval job returns.
+type vaultInventoryOutput struct {
+    VaultARN string
+    InventoryDate time.Time
+    ArchiveList []vaultArchive
+}
+
+type vaultArchive struct {
+    ArchiveId string
+    ArchiveDescription string
+    CreationDate time.Time
+    Size int64
+    SHA256TreeHash string
+}
+
+func vaultInventory(svc *glacier.Glacier, args *Arguments) error {
+    if len(args.Vault) == 0 {
+        return fmt.Errorf("vault_inventory requires --vault")
+    }
+    jobId := args.JobId
+    if len(jobId) == 0 {
+        var err error
+        jobId, err = initiateVaultJob(svc, args, &glacier.JobParameters{
+            Type: aws.String("inventory-retrieval"),
+            Format: aws.String("JSON")})
+        if err != nil {
+            return err
+        }
+    }
+    err := waitForVaultJob(svc, args.AccountId, args.Vault, jobId, args.PollInterval)
+    if err != nil {
+        return err
+    }
+    inventory, err := getVaultInventory(svc, args.AccountId, args.Vault, jobId)
+    if err != nil {
+        return err
+    }
+    return printVaultInventory(inventory, args.OutputFile, args.Format)
+}
+
+func describeVaultJob(svc *glacier.Glacier, args *Arguments) error {
+    if len(args.Vault) == 0 || len(args.JobId) == 0 {
+        return fmt.Errorf("describe_job requires --vault and --job-id")
+    }
+    job, err := svc.DescribeJob(&glacier.DescribeJobInput{
+        AccountId: aws.String(args.AccountId),
+        VaultName: aws.String(args.Vault),
+        JobId: aws.String(args.JobId)})
+    if err != nil {
+        return err
+    }
+    fmt.Fprintf(statusOut, "Job %s: %s %s created %s completed %s\n",
+        args.JobId, aws.StringValue(job.Action), aws.StringValue(job.StatusCode),
+        aws.StringValue(job.CreationDate), aws.StringValue(job.CompletionDate))
+    if job.StatusMessage != nil {
+        fmt.Fprintf(statusOut, "Status: %s\n", *job.StatusMessage)
+    }
+    return nil
+}
+
+func initiateVaultJob(svc *glacier.Glacier, args *Arguments, params *glacier.JobParameters) (string, error) {
+    result, err := svc.InitiateJob(&glacier.InitiateJobInput{
+        AccountId: aws.String(args.AccountId),
+        VaultName: aws.String(args.Vault),
+        JobParameters: params})
+    if err != nil {
+        return "", fmt.Errorf("failed to initiate %s job on vault %s, %v\n",
+            aws.StringValue(params.Type), args.Vault, err)
+    }
+    // the job id lets an interrupted run pick the job up again with --job-id
+    fmt.Fprintf(statusOut, "Job initiated: %s %s %s\n", aws.StringValue(params.Type),
+        aws.StringValue(result.JobId), time.Now().Format(time.RFC3339))
+    return aws.StringValue(result.JobId), nil
+}
+
+// waitForVaultJob polls DescribeJob every interval until the job completes.
+func waitForVaultJob(svc *glacier.Glacier, accountId string, vault string, jobId string, interval time.Duration) error {
+    for {
+        job, err := svc.DescribeJob(&glacier.DescribeJobInput{
+            AccountId: aws.String(accountId),
+            VaultName: aws.String(vault),
+            JobId: aws.String(jobId)})
+        if err != nil {
+            return fmt.Errorf("Describe job failed: %v\n", err)
+        }
+        switch aws.StringValue(job.StatusCode) {
+        case glacier.StatusCodeSucceeded:
+            fmt.Fprintf(statusOut, "Job complete: %s %s\n", jobId, time.Now().Format(time.RFC3339))
+            return nil
+        case glacier.StatusCodeFailed:
+            return fmt.Errorf("job %s failed: %s\n", jobId, aws.StringValue(job.StatusMessage))
+        }
+        time.Sleep(interval)
+    }
+}
+
+func getVaultInventory(svc *glacier.Glacier, accountId string, vault string, jobId string) (*vaultInventoryOutput, error) {
+    output, err := svc.GetJobOutput(&glacier.GetJobOutputInput{
+        AccountId: aws.String(accountId),
+        VaultName: aws.String(vault),
+        JobId: aws.String(jobId)})
+    if err != nil {
+        return nil, fmt.Errorf("failed to get inventory for job %s, %v\n", jobId, err)
+    }
+    defer output.Body.Close()
+
+    inventory := &vaultInventoryOutput{}
+    err = json.NewDecoder(output.Body).Decode(inventory)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse inventory for job %s, %v\n", jobId, err)
+    }
+    return inventory, nil
+}
+
+// printVaultInventory writes each archive with its description, the only
+// link to the file it holds, and tree hash. vault_retrieve reads the output
+// back as its --archive-list.
+func printVaultInventory(inventory *vaultInventoryOutput, outputFile string, format string) error {
+    report, err := newReportWriter(outputFile, format, client.VaultArchivesColumns)
+    if err != nil {
+        return err
+    }
+    defer report.Close()
+
+    for _, archive := range inventory.ArchiveList {
+        err = report.Write(archive.ArchiveId, archive.ArchiveDescription, archive.Size, archive.CreationDate, archive.SHA256TreeHash)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
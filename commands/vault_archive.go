@@ -0,0 +1,331 @@
+package commands
+
+import (
+    "bufio"
+    "encoding/base64"
+    "encoding/csv"
+    "encoding/hex"
+    "fmt"
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/glacier"
+    "io"
+    "os"
+    "path"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "sync"
+)
+
+// vaultChunkSize is a power-of-two number of megabytes so every chunk is tree
+// hash aligned and Glacier returns a checksum for it.
+const vaultChunkSize = 64 * 1024 * 1024
+const vaultChunkAttempts = 3
+
+// archiveListSource yields archive ids, from --archive-id or from an
+// --archive-list file of "archiveId[,description]" lines. The vault_inventory
+// output, with its header, can be used as the list; its description and tree
+// hash columns are read too.
+type archiveListSource struct {
+    archiveId string
+    listFile string
+    mu sync.Mutex
+    archives map[string]archiveListEntry
+}
+
+// archiveListEntry is what the archive list says about an archive.
+type archiveListEntry struct {
+    Description string
+    TreeHash string
+}
+
+func (src *archiveListSource) archive(archiveId string) archiveListEntry {
+    src.mu.Lock()
+    defer src.mu.Unlock()
+    return src.archives[archiveId]
+}
+
+func (src *archiveListSource) Walk(visit func(*objectEntry) error) error {
+    if len(src.archiveId) > 0 {
+        return visit(&objectEntry{Key: src.archiveId})
+    }
+    f, err := os.Open(src.listFile)
+    if err != nil {
+        return fmt.Errorf("Could not open %s\n%v\n", src.listFile, err)
+    }
+    defer f.Close()
+
+    r := csv.NewReader(bufio.NewReader(f))
+    r.FieldsPerRecord = -1
+    descriptionIndex, treeHashIndex := 1, -1
+    first := true
+    for {
+        record, err := r.Read()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return fmt.Errorf("failed reading %s %v\n", src.listFile, err)
+        }
+        archiveId := strings.TrimSpace(record[0])
+        if first {
+            first = false
+            switch archiveId {
+            case "Key":
+                // the older vault_inventory layout had size, not a description, second
+                descriptionIndex = -1
+                continue
+            case "ArchiveId", "Archive Id":
+                descriptionIndex = headerIndex(record, "Description", "ArchiveDescription")
+                treeHashIndex = headerIndex(record, "SHA256 Tree Hash", "SHA256TreeHash")
+                continue
+            }
+        }
+        if len(archiveId) == 0 {
+            continue
+        }
+        entry := archiveListEntry{}
+        if descriptionIndex >= 0 && descriptionIndex < len(record) {
+            entry.Description = record[descriptionIndex]
+        }
+        if treeHashIndex >= 0 && treeHashIndex < len(record) {
+            entry.TreeHash = strings.TrimSpace(record[treeHashIndex])
+        }
+        src.mu.Lock()
+        src.archives[archiveId] = entry
+        src.mu.Unlock()
+        if err = visit(&objectEntry{Key: archiveId}); err != nil {
+            return err
+        }
+    }
+}
+
+// headerIndex finds the first of names in a header row, -1 if none is there.
+func headerIndex(header []string, names ...string) int {
+    for _, name := range names {
+        for i, column := range header {
+            if strings.EqualFold(strings.TrimSpace(column), name) {
+                return i
+            }
+        }
+    }
+    return -1
+}
+
+func vaultRetrieve(svc *glacier.Glacier, args *Arguments) error {
+    if len(args.Vault) == 0 {
+        return fmt.Errorf("vault_retrieve requires --vault")
+    }
+    if len(args.ArchiveId) == 0 && len(args.ArchiveList) == 0 {
+        return fmt.Errorf("Must specify either archive-id or archive-list")
+    }
+    tier, err := parseTier(args.Tier)
+    if err != nil {
+        return err
+    }
+    paths, err := newOutputPaths(args)
+    if err != nil {
+        return err
+    }
+    source := &archiveListSource{archiveId: args.ArchiveId, listFile: args.ArchiveList, archives: map[string]archiveListEntry{}}
+
+    // start every retrieval first; they all take hours so wait on them together
+    var jobsLock sync.Mutex
+    jobs := map[string]string{}
+    skipped := map[string]bool{}
+    if len(args.JobId) > 0 && len(args.ArchiveId) > 0 {
+        jobs[args.ArchiveId] = args.JobId
+    } else {
+        result, err := newWorkerPool(args.Concurrency).Run(source, func(object *objectEntry) error {
+            // with the description from the list the file is known before any retrieval
+            if description := source.archive(object.Key).Description; len(description) > 0 {
+                if target, skip := paths.skipExisting(archiveFileName(description, object.Key)); skip {
+                    fmt.Fprintf(statusOut, "Skipped, file exists: %s\n", target)
+                    jobsLock.Lock()
+                    skipped[object.Key] = true
+                    jobsLock.Unlock()
+                    return nil
+                }
+            }
+            jobId, err := initiateVaultJob(svc, args, &glacier.JobParameters{
+                Type: aws.String("archive-retrieval"),
+                ArchiveId: aws.String(object.Key),
+                Tier: aws.String(tier)})
+            if err != nil {
+                return err
+            }
+            jobsLock.Lock()
+            jobs[object.Key] = jobId
+            jobsLock.Unlock()
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+        result.PrintSummary("vault_retrieve initiate")
+    }
+
+    result, err := newWorkerPool(args.Concurrency).Run(source, func(object *objectEntry) error {
+        jobsLock.Lock()
+        jobId, ok := jobs[object.Key]
+        skip := skipped[object.Key]
+        jobsLock.Unlock()
+        if skip {
+            return nil
+        }
+        if !ok {
+            return fmt.Errorf("no retrieval job")
+        }
+        err := waitForVaultJob(svc, args.AccountId, args.Vault, jobId, args.PollInterval)
+        if err != nil {
+            return err
+        }
+        return doGetArchive(svc, args.AccountId, args.Vault, jobId, source.archive(object.Key), paths)
+    })
+    if err != nil {
+        return err
+    }
+    result.PrintSummary("vault_retrieve")
+    if len(result.Failed) > 0 {
+        return fmt.Errorf("failed retrieving %d archives", len(result.Failed))
+    }
+    return nil
+}
+
+// doGetArchive downloads the output of a completed archive-retrieval job in
+// ranged chunks, checking each chunk and then the whole file against Glacier's
+// SHA-256 tree hash. The file only takes its final name once it verifies.
+func doGetArchive(svc *glacier.Glacier, accountId string, vault string, jobId string, listed archiveListEntry, paths *outputPaths) error {
+    job, err := svc.DescribeJob(&glacier.DescribeJobInput{
+        AccountId: aws.String(accountId),
+        VaultName: aws.String(vault),
+        JobId: aws.String(jobId)})
+    if err != nil {
+        return fmt.Errorf("Describe job failed: %v\n", err)
+    }
+    archiveId := aws.StringValue(job.ArchiveId)
+    size := aws.Int64Value(job.ArchiveSizeInBytes)
+    description := listed.Description
+
+    // the description, and so the file name, may only be known from the output
+    if err = os.MkdirAll(paths.tempDir(), 0755); err != nil {
+        return err
+    }
+    partName := filepath.Join(paths.tempDir(), archiveId + ".part")
+    file, err := os.Create(partName)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    placed := false
+    defer func() {
+        if !placed {
+            os.Remove(partName)
+        }
+    }()
+
+    for start := int64(0); start < size; start += vaultChunkSize {
+        end := start + vaultChunkSize - 1
+        if end >= size {
+            end = size - 1
+        }
+        chunkDescription, err := getArchiveChunk(svc, accountId, vault, jobId, file, start, end)
+        if err != nil {
+            return err
+        }
+        if len(description) == 0 {
+            description = chunkDescription
+        }
+    }
+
+    if _, err = file.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    treeHash := hex.EncodeToString(glacier.ComputeHashes(file).TreeHash)
+    expected := aws.StringValue(job.ArchiveSHA256TreeHash)
+    if len(expected) == 0 {
+        expected = aws.StringValue(job.SHA256TreeHash)
+    }
+    if size > 0 && treeHash != expected {
+        return fmt.Errorf("tree hash mismatch for archive %s: got %s, expected %s\n", archiveId, treeHash, expected)
+    }
+    if size > 0 && len(listed.TreeHash) > 0 && treeHash != listed.TreeHash {
+        return fmt.Errorf("tree hash mismatch for archive %s: got %s, archive list has %s\n", archiveId, treeHash, listed.TreeHash)
+    }
+    if err = file.Close(); err != nil {
+        return err
+    }
+
+    target, skip, err := paths.prepare(archiveFileName(description, archiveId))
+    if err != nil {
+        return err
+    }
+    if skip {
+        fmt.Fprintf(statusOut, "Skipped, file exists: %s\n", target)
+        return nil
+    }
+    fileName, err := paths.place(partName, target)
+    if err != nil {
+        return err
+    }
+    placed = true
+    fmt.Fprintf(statusOut, "Restored: %s\n", fileName)
+    return nil
+}
+
+// getArchiveChunk writes bytes start-end of a job's output at the same offset
+// in file, retrying a chunk whose tree hash does not match the checksum Glacier
+// sent with it. It returns the archive description Glacier reports.
+func getArchiveChunk(svc *glacier.Glacier, accountId string, vault string, jobId string, file *os.File, start int64, end int64) (string, error) {
+    var lastErr error
+    for attempt := 1; attempt <= vaultChunkAttempts; attempt++ {
+        output, err := svc.GetJobOutput(&glacier.GetJobOutputInput{
+            AccountId: aws.String(accountId),
+            VaultName: aws.String(vault),
+            JobId: aws.String(jobId),
+            Range: aws.String(fmt.Sprintf("bytes=%d-%d", start, end))})
+        if err != nil {
+            lastErr = fmt.Errorf("failed to get job output %s bytes %d-%d, %v\n", jobId, start, end, err)
+            continue
+        }
+        if _, err = file.Seek(start, io.SeekStart); err == nil {
+            _, err = io.Copy(file, output.Body)
+        }
+        output.Body.Close()
+        if err != nil {
+            lastErr = fmt.Errorf("failed writing job output %s bytes %d-%d, %v\n", jobId, start, end, err)
+            continue
+        }
+        if output.Checksum != nil {
+            chunk := io.NewSectionReader(file, start, end - start + 1)
+            chunkHash := hex.EncodeToString(glacier.ComputeHashes(chunk).TreeHash)
+            if chunkHash != *output.Checksum {
+                lastErr = fmt.Errorf("tree hash mismatch for job %s bytes %d-%d\n", jobId, start, end)
+                continue
+            }
+        }
+        return aws.StringValue(output.ArchiveDescription), nil
+    }
+    return "", lastErr
+}
+
+var fastGlacierPath = regexp.MustCompile(`<p>([^<]*)</p>`)
+
+// archiveFileName maps an archive description back to the path of the file
+// that was uploaded, which is then placed like an S3 key. Descriptions written
+// by FastGlacier-style tools carry the base64 encoded path in a <p> element;
+// anything else is taken as the path.
+func archiveFileName(description string, archiveId string) string {
+    name := description
+    if match := fastGlacierPath.FindStringSubmatch(description); match != nil {
+        if decoded, err := base64.StdEncoding.DecodeString(match[1]); err == nil {
+            name = string(decoded)
+        }
+    }
+    name = strings.ReplaceAll(name, "\\", "/")
+    base := path.Base(name)
+    if len(description) == 0 || base == "." || base == "/" || base == ".." {
+        return archiveId
+    }
+    return name
+}
@@ -0,0 +1,62 @@
+package commands
+
+import (
+    "github.com/SpectraLogic/glacier_recover/client"
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "io"
+    "os"
+    "strings"
+)
+
+const (
+    verifyOK = "verified"
+    verifyMismatch = "mismatch"
+    verifyUnverified = "unverified"
+)
+
+var verifyReportHeader = []string{"Key", "Version Id", "File", "Size", "Checks", "Result", "Detail", "Retries"}
+
+// verifyResult is the outcome of checking one downloaded file.
+type verifyResult struct {
+    Key string
+    VersionId string
+    File string
+    Size int64
+    Checks []string
+    Result string
+    Detail string
+    Retries int
+}
+
+func (result *verifyResult) row() []interface{} {
+    return []interface{}{result.Key, result.VersionId, result.File, result.Size,
+        strings.Join(result.Checks, "+"), result.Result, result.Detail, result.Retries}
+}
+
+// verifyDownload compares the bytes in fileName with what S3 reports for the
+// object, using the checks of client.ObjectChecker. Failing to read fileName
+// is an error, not a mismatch, as it says nothing about the data.
+func verifyDownload(svc *s3.S3, bucket string, key string, versionId string, fileName string, head *s3.HeadObjectOutput) (*verifyResult, error) {
+    result := &verifyResult{Key: key, VersionId: versionId, File: fileName, Size: aws.Int64Value(head.ContentLength), Result: verifyOK}
+    checker := client.NewObjectChecker(svc, bucket, key, versionId, head)
+    f, err := os.Open(fileName)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    if _, err = io.Copy(checker, f); err != nil {
+        return nil, err
+    }
+
+    checks, note, err := checker.Verify()
+    result.Checks = checks
+    result.Detail = note
+    if err != nil {
+        result.Result = verifyMismatch
+        result.Detail = strings.TrimSpace(result.Detail + " " + err.Error())
+    } else if len(result.Checks) == 0 {
+        result.Result = verifyUnverified
+    }
+    return result, nil
+}